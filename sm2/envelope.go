@@ -0,0 +1,193 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// Envelopes encrypting one message for several recipients
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"io"
+
+	"github.com/tjfoc/gmsm/sm4"
+)
+
+// Envelope is a message encrypted once with a random SM4 key in GCM mode,
+// with that key SM2 encrypted for each recipient.
+type Envelope struct {
+	Recipients []EnvelopeRecipient
+	Nonce      []byte
+	Ciphertext []byte // SM4-GCM ciphertext and tag
+}
+
+// EnvelopeRecipient holds the SM4 key of an Envelope for one recipient.
+type EnvelopeRecipient struct {
+	Fingerprint []byte // PublicKeyFingerprint of the recipient's key
+	WrappedKey  []byte // SM2 ciphertext of the SM4 key, C1C3C2
+}
+
+// SealEnvelope encrypts msg for each of recipients.
+func SealEnvelope(recipients []*PublicKey, msg []byte) (*Envelope, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("SM2: envelope without recipients")
+	}
+	key := make([]byte, sm4.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	env := new(Envelope)
+	for _, pub := range recipients {
+		wrapped, err := Encrypt(pub, key)
+		if err != nil {
+			return nil, err
+		}
+		env.Recipients = append(env.Recipients, EnvelopeRecipient{
+			Fingerprint: PublicKeyFingerprint(pub),
+			WrappedKey:  wrapped,
+		})
+	}
+	aead, err := envelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {
+		return nil, err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, msg, nil)
+	return env, nil
+}
+
+// ErrTagMismatch is returned by OpenEnvelope and DecryptHybrid when the key
+// was unwrapped but the SM4-GCM tag does not verify: the nonce or the
+// ciphertext was modified. A key that is not a recipient gets another
+// error.
+var ErrTagMismatch = errors.New("SM2: envelope authentication tag mismatch")
+
+// OpenEnvelope decrypts env with priv, using the wrapped key whose
+// fingerprint matches the public key of priv.
+func OpenEnvelope(priv *PrivateKey, env *Envelope) ([]byte, error) {
+	if nilPrivateKey(priv) {
+		return nil, ErrNilKey
+	}
+	fp := PublicKeyFingerprint(&priv.PublicKey)
+	for _, rcpt := range env.Recipients {
+		if !bytes.Equal(rcpt.Fingerprint, fp) {
+			continue
+		}
+		key, err := Decrypt(priv, rcpt.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != sm4.BlockSize {
+			return nil, errors.New("SM2: invalid envelope key")
+		}
+		aead, err := envelopeAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(env.Nonce) != aead.NonceSize() {
+			return nil, errors.New("SM2: invalid envelope nonce")
+		}
+		msg, err := aead.Open(nil, env.Nonce, env.Ciphertext, nil)
+		if err != nil {
+			return nil, ErrTagMismatch
+		}
+		return msg, nil
+	}
+	return nil, errors.New("SM2: envelope is not addressed to this key")
+}
+
+// MarshalEnvelope returns the ASN.1 DER encoding of env.
+func MarshalEnvelope(env *Envelope) ([]byte, error) {
+	return asn1.Marshal(*env)
+}
+
+// ParseEnvelope parses an envelope encoded by MarshalEnvelope.
+func ParseEnvelope(der []byte) (*Envelope, error) {
+	env := new(Envelope)
+	rest, err := asn1.Unmarshal(der, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("SM2: trailing data after envelope")
+	}
+	return env, nil
+}
+
+// HybridThreshold is the largest message EncryptHybrid encrypts with SM2
+// directly; longer ones are sealed in an Envelope.
+const HybridThreshold = 256
+
+// Modes of EncryptHybrid, the first byte of its output.
+const (
+	hybridDirect   = 0 // C1C3C2 SM2 ciphertext
+	hybridEnvelope = 1 // MarshalEnvelope of a single recipient envelope
+)
+
+// EncryptHybrid encrypts msg for pub. Messages of up to HybridThreshold
+// bytes are SM2 encrypted, adding 97 bytes. Longer ones are sealed in an
+// Envelope, encrypted with SM4-GCM under a random SM2 encrypted key, which
+// adds about 200 bytes but avoids running the SM3 KDF over the whole
+// message. The first byte of the output records the mode for
+// DecryptHybrid.
+func EncryptHybrid(pub *PublicKey, msg []byte) ([]byte, error) {
+	if len(msg) <= HybridThreshold {
+		c, err := Encrypt(pub, msg)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{hybridDirect}, c...), nil
+	}
+	env, err := SealEnvelope([]*PublicKey{pub}, msg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := MarshalEnvelope(env)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{hybridEnvelope}, der...), nil
+}
+
+// DecryptHybrid decrypts the output of EncryptHybrid.
+func DecryptHybrid(priv *PrivateKey, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("SM2: empty hybrid ciphertext")
+	}
+	switch data[0] {
+	case hybridDirect:
+		return Decrypt(priv, data[1:])
+	case hybridEnvelope:
+		env, err := ParseEnvelope(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		return OpenEnvelope(priv, env)
+	}
+	return nil, errors.New("SM2: unknown hybrid ciphertext mode")
+}
+
+func envelopeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// JSON Web Key (RFC 7517) encoding of SM2 keys
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+// MarshalJWK returns the JWK of pub, with "kty":"EC" and "crv":"SM2".
+func MarshalJWK(pub *PublicKey) ([]byte, error) {
+	if nilPublicKey(pub) {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(pub.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
+	return json.Marshal(publicJWK(pub))
+}
+
+// MarshalPrivateJWK returns the JWK of priv, which includes the "d" member.
+func MarshalPrivateJWK(priv *PrivateKey) ([]byte, error) {
+	if nilPrivateKey(priv) {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(priv.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
+	key := publicJWK(&priv.PublicKey)
+	key.D = base64.RawURLEncoding.EncodeToString(bigIntTo32Bytes(priv.D))
+	return json.Marshal(key)
+}
+
+func publicJWK(pub *PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Crv: "SM2",
+		X:   base64.RawURLEncoding.EncodeToString(bigIntTo32Bytes(pub.X)),
+		Y:   base64.RawURLEncoding.EncodeToString(bigIntTo32Bytes(pub.Y)),
+	}
+}
+
+// ParseJWK parses an SM2 public key JWK. A "d" member, if present, is
+// ignored.
+func ParseJWK(data []byte) (*PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return parsePublicJWK(&key)
+}
+
+// ParsePrivateJWK parses an SM2 private key JWK. The public point must match
+// the private scalar.
+func ParsePrivateJWK(data []byte) (*PrivateKey, error) {
+	var key jwk
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicJWK(&key)
+	if err != nil {
+		return nil, err
+	}
+	d, err := jwkCoordinate(key.D)
+	if err != nil {
+		return nil, err
+	}
+	priv := &PrivateKey{D: d}
+	priv.Curve = pub.Curve
+	if err := priv.Recompute(); err != nil {
+		return nil, err
+	}
+	if priv.X.Cmp(pub.X) != 0 || priv.Y.Cmp(pub.Y) != 0 {
+		return nil, errors.New("SM2: JWK public key does not match the private key")
+	}
+	return priv, nil
+}
+
+func parsePublicJWK(key *jwk) (*PublicKey, error) {
+	if key.Kty != "EC" || key.Crv != "SM2" {
+		return nil, errors.New("SM2: JWK is not an SM2 key")
+	}
+	x, err := jwkCoordinate(key.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := jwkCoordinate(key.Y)
+	if err != nil {
+		return nil, err
+	}
+	curve := P256Sm2()
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("SM2: JWK point is not on curve")
+	}
+	return &PublicKey{
+		Curve: curve,
+		X:     x,
+		Y:     y,
+	}, nil
+}
+
+// jwkCoordinate decodes a base64url coordinate or scalar, which RFC 7518
+// requires to be the full 32 bytes.
+func jwkCoordinate(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, errors.New("SM2: invalid JWK member length")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// SM2 key exchange, GB/T 32918.3-2016
+import (
+	"errors"
+	"math/big"
+
+	"github.com/tjfoc/gmsm/sm3"
+)
+
+// KeyExchangeA computes the initiator (A) side of the SM2 key exchange.
+//
+// klen is the length of the agreed key in bytes, ida and idb are the user
+// IDs of A and B, priv is A's static private key, pub is B's static public
+// key, rpri is A's ephemeral private key and rpub is B's ephemeral public
+// key RB.
+//
+// s1 is the value A compares with SB received from B, s2 is SA which A
+// sends to B.
+func KeyExchangeA(klen int, ida, idb []byte, priv *PrivateKey, pub *PublicKey, rpri *PrivateKey, rpub *PublicKey) (k, s1, s2 []byte, err error) {
+	return keyExchange(klen, ida, idb, priv, pub, rpri, rpub, true)
+}
+
+// KeyExchangeB computes the responder (B) side of the SM2 key exchange.
+//
+// klen is the length of the agreed key in bytes, ida and idb are the user
+// IDs of A and B, priv is B's static private key, pub is A's static public
+// key, rpri is B's ephemeral private key and rpub is A's ephemeral public
+// key RA.
+//
+// s1 is SB which B sends to A, s2 is the value B compares with SA received
+// from A.
+func KeyExchangeB(klen int, ida, idb []byte, priv *PrivateKey, pub *PublicKey, rpri *PrivateKey, rpub *PublicKey) (k, s1, s2 []byte, err error) {
+	return keyExchange(klen, ida, idb, priv, pub, rpri, rpub, false)
+}
+
+func keyExchange(klen int, ida, idb []byte, priv *PrivateKey, pub *PublicKey, rpri *PrivateKey, rpub *PublicKey, thisIsA bool) (k, s1, s2 []byte, err error) {
+	if nilPrivateKey(priv) || nilPublicKey(pub) || nilPrivateKey(rpri) || nilPublicKey(rpub) {
+		return nil, nil, nil, ErrNilKey
+	}
+	if !isSM2Curve(priv.Curve) || !isSM2Curve(pub.Curve) || !isSM2Curve(rpri.Curve) || !isSM2Curve(rpub.Curve) {
+		return nil, nil, nil, ErrUnsupportedCurve
+	}
+	if klen <= 0 {
+		return nil, nil, nil, errors.New("SM2: invalid key length")
+	}
+	curve := priv.Curve
+	N := curve.Params().N
+	// Points off the curve would let the peer run an invalid curve attack
+	// on priv.D. The cofactor is 1, so every other point but the point at
+	// infinity is in the subgroup of order n.
+	if err := ValidatePublicKey(pub); err != nil {
+		return nil, nil, nil, errors.New("SM2: peer's public key: " + err.Error())
+	}
+	if err := ValidatePublicKey(rpub); err != nil {
+		return nil, nil, nil, errors.New("SM2: peer's ephemeral public key: " + err.Error())
+	}
+	// t = (d + x̄ * r) mod n
+	t := new(big.Int).Mul(kxBar(rpri.PublicKey.X), rpri.D)
+	t.Add(t, priv.D)
+	t.Mod(t, N)
+	// V = [h * t](P + [x̄']R'), h = 1
+	x, y := curve.ScalarMult(rpub.X, rpub.Y, kxBar(rpub.X).Bytes())
+	x, y = curve.Add(pub.X, pub.Y, x, y)
+	vx, vy := curve.ScalarMult(x, y, t.Bytes())
+	if vx.Sign() == 0 && vy.Sign() == 0 {
+		return nil, nil, nil, errors.New("SM2: key exchange failed")
+	}
+
+	var za, zb []byte
+	var ra, rb *PublicKey
+	if thisIsA {
+		if za, err = ZA(&priv.PublicKey, ida); err != nil {
+			return nil, nil, nil, err
+		}
+		if zb, err = ZA(pub, idb); err != nil {
+			return nil, nil, nil, err
+		}
+		ra, rb = &rpri.PublicKey, rpub
+	} else {
+		if za, err = ZA(pub, ida); err != nil {
+			return nil, nil, nil, err
+		}
+		if zb, err = ZA(&priv.PublicKey, idb); err != nil {
+			return nil, nil, nil, err
+		}
+		ra, rb = rpub, &rpri.PublicKey
+	}
+	vxBuf, vyBuf := bigIntTo32Bytes(vx), bigIntTo32Bytes(vy)
+
+	k, ok := kdf(klen, vxBuf, vyBuf, za, zb)
+	if !ok {
+		return nil, nil, nil, errors.New("SM2: key exchange failed")
+	}
+
+	// Hash(xV || ZA || ZB || x1 || y1 || x2 || y2)
+	h := sm3.New()
+	h.Write(vxBuf)
+	h.Write(za)
+	h.Write(zb)
+	h.Write(bigIntTo32Bytes(ra.X))
+	h.Write(bigIntTo32Bytes(ra.Y))
+	h.Write(bigIntTo32Bytes(rb.X))
+	h.Write(bigIntTo32Bytes(rb.Y))
+	inner := h.Sum(nil)
+
+	s1 = kxTag(0x02, vyBuf, inner)
+	s2 = kxTag(0x03, vyBuf, inner)
+	return k, s1, s2, nil
+}
+
+// kxBar computes x̄ = 2^w + (x & (2^w - 1)) with w = 127
+func kxBar(x *big.Int) *big.Int {
+	w := new(big.Int).Lsh(one, 127)
+	xb := new(big.Int).Sub(w, one)
+	xb.And(xb, x)
+	return xb.Add(xb, w)
+}
+
+// kxTag computes Hash(tag || yV || inner)
+func kxTag(tag byte, vy, inner []byte) []byte {
+	h := sm3.New()
+	h.Write([]byte{tag})
+	h.Write(vy)
+	h.Write(inner)
+	return h.Sum(nil)
+}
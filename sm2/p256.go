@@ -18,6 +18,7 @@ package sm2
 import (
 	"crypto/elliptic"
 	"math/big"
+	"math/bits"
 	"sync"
 )
 
@@ -50,11 +51,16 @@ type sm2P256Curve struct {
 	RInverse *big.Int
 	*elliptic.CurveParams
 	a, b, gx, gy sm2P256FieldElement
+	rr           sm2P256FieldElement // R^2 mod P without the factor R
 }
 
 var initonce sync.Once
 var sm2P256 sm2P256Curve
 
+// p256Sm2 is sm2P256 converted to elliptic.Curve once, so P256Sm2 does not
+// copy the struct into a new interface value on every call.
+var p256Sm2 elliptic.Curve
+
 type sm2P256FieldElement [9]uint32
 type sm2P256LargeFieldElement [17]uint64
 
@@ -78,11 +84,18 @@ func initP256Sm2() {
 	sm2P256FromBig(&sm2P256.gx, sm2P256.Gx)
 	sm2P256FromBig(&sm2P256.gy, sm2P256.Gy)
 	sm2P256FromBig(&sm2P256.b, sm2P256.B)
+	sm2P256FromBig(&sm2P256.rr, new(big.Int).Mod(new(big.Int).Lsh(big.NewInt(1), 257), sm2P256.P))
+	p256Sm2 = sm2P256
 }
 
+// P256Sm2 returns the curve of GM/T 0003.5. Its Params are the published
+// constants P, N, B, Gx and Gy; the curve has a = P - 3, like the NIST
+// curves, and cofactor 1. The values are shared: callers must not modify
+// them. The curve is initialized on the first call and the same value is
+// returned by every call.
 func P256Sm2() elliptic.Curve {
 	initonce.Do(initP256Sm2)
-	return sm2P256
+	return p256Sm2
 }
 
 func (curve sm2P256Curve) Params() *elliptic.CurveParams {
@@ -117,6 +130,17 @@ func zForAffine(x, y *big.Int) *big.Int {
 func (curve sm2P256Curve) Add(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
 	var X1, Y1, Z1, X2, Y2, Z2, X3, Y3, Z3 sm2P256FieldElement
 
+	// sm2P256PointAdd handles neither the point at infinity nor adding a
+	// point to itself. The inputs here are public, so check for them.
+	if x1.Sign() == 0 && y1.Sign() == 0 {
+		return new(big.Int).Set(x2), new(big.Int).Set(y2)
+	}
+	if x2.Sign() == 0 && y2.Sign() == 0 {
+		return new(big.Int).Set(x1), new(big.Int).Set(y1)
+	}
+	if x1.Cmp(x2) == 0 && y1.Cmp(y2) == 0 {
+		return curve.Double(x1, y1)
+	}
 	z1 := zForAffine(x1, y1)
 	z2 := zForAffine(x2, y2)
 	sm2P256FromBig(&X1, x1)
@@ -140,6 +164,120 @@ func (curve sm2P256Curve) Double(x1, y1 *big.Int) (*big.Int, *big.Int) {
 	return sm2P256ToAffine(&X1, &Y1, &Z1)
 }
 
+// sm2P256Scratch holds the big.Int temporary of conversions between field
+// elements and big.Int. Once it has grown, converting does not allocate.
+type sm2P256Scratch struct {
+	t big.Int
+}
+
+// sm2P256RawOne is 1 without the factor R.
+var sm2P256RawOne = sm2P256FieldElement{1}
+
+// sm2P256SetLimbs sets the limbs of X to 0 <= a < 2^257, without the
+// factor R.
+func sm2P256SetLimbs(X *sm2P256FieldElement, a *big.Int) {
+	words := a.Bits()
+	off := uint(0)
+	for i := range X {
+		n := uint(29)
+		if i&1 == 1 {
+			n = 28
+		}
+		X[i] = 0
+		for j := uint(0); j < n; j++ {
+			w := (off + j) / bits.UintSize
+			if w < uint(len(words)) && words[w]>>((off+j)%bits.UintSize)&1 == 1 {
+				X[i] |= 1 << j
+			}
+		}
+		off += n
+	}
+}
+
+// fromBig is sm2P256FromBig for 0 <= a < 2^257, multiplying by R^2 instead
+// of dividing.
+func (t *sm2P256Scratch) fromBig(X *sm2P256FieldElement, a *big.Int) {
+	var raw sm2P256FieldElement
+	sm2P256SetLimbs(&raw, a)
+	sm2P256Mul(X, &raw, &sm2P256.rr)
+}
+
+// toBig is sm2P256ToBig storing the result in r. A multiplication by 1
+// removes the factor R and subtractions reduce the result.
+func (t *sm2P256Scratch) toBig(r *big.Int, X *sm2P256FieldElement) {
+	var x sm2P256FieldElement
+	sm2P256Mul(&x, X, &sm2P256RawOne)
+	r.SetInt64(int64(x[8]))
+	for i := 7; i >= 0; i-- {
+		if (i & 1) == 0 {
+			r.Lsh(r, 29)
+		} else {
+			r.Lsh(r, 28)
+		}
+		t.t.SetInt64(int64(x[i]))
+		r.Add(r, &t.t)
+	}
+	for r.Cmp(sm2P256.P) >= 0 {
+		r.Sub(r, sm2P256.P)
+	}
+}
+
+// sm2P256GetScalarInt is sm2P256GetScalar for 0 <= a < n, reading the words
+// of a instead of allocating its bytes.
+func sm2P256GetScalarInt(b *[32]byte, a *big.Int) {
+	*b = [32]byte{}
+	i := 0
+	for _, w := range a.Bits() {
+		for j := 0; j < bits.UintSize/8 && i < len(b); j++ {
+			b[i] = byte(w >> uint(8*j))
+			i++
+		}
+	}
+}
+
+// verifyMult is the point arithmetic of a verification with scratch values:
+// it reports whether (x + e) mod n = r for (x, y) = [s]G + [t](x1, y1), with
+// c = (r - e) mod n. Rather than converting the sum to affine coordinates,
+// which needs an inversion, it tests whether X = x Z^2 for the two values of
+// x < p that are congruent to c. done is false if the sum is the point at
+// infinity or a doubling, for the caller to handle.
+func (curve sm2P256Curve) verifyMult(tmp *sm2P256Scratch, x1, y1 *sm2P256FieldElement, s, t, c, res *big.Int) (valid, done bool) {
+	var sReversed, tReversed [32]byte
+	var X1, Y1, Z1, X2, Y2, Z2, X3, Y3, Z3, zz, cf, d sm2P256FieldElement
+
+	// s and t are in [1, n-1] and (x1, y1) has order n, so neither product
+	// is the point at infinity.
+	sm2P256GetScalarInt(&sReversed, s)
+	sm2P256ScalarBaseMult(&X1, &Y1, &Z1, &sReversed)
+	sm2P256GetScalarInt(&tReversed, t)
+	sm2P256ScalarMult(&X2, &Y2, &Z2, x1, y1, &tReversed)
+	sm2P256PointAdd(&X1, &Y1, &Z1, &X2, &Y2, &Z2, &X3, &Y3, &Z3)
+	tmp.toBig(res, &Z3)
+	if res.Sign() == 0 {
+		return false, false
+	}
+
+	sm2P256Square(&zz, &Z3)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			c.Add(c, curve.N)
+			if c.Cmp(curve.P) >= 0 {
+				break
+			}
+		}
+		tmp.fromBig(&cf, c)
+		sm2P256Mul(&cf, &cf, &zz)
+		sm2P256Sub(&d, &X3, &cf)
+		tmp.toBig(res, &d)
+		if res.Sign() == 0 {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// ScalarMult and ScalarBaseMult run in time independent of the value of k.
+// The conversions of the point from and to big.Int are not constant time.
 func (curve sm2P256Curve) ScalarMult(x1, y1 *big.Int, k []byte) (*big.Int, *big.Int) {
 	var scalarReversed [32]byte
 	var X, Y, Z, X1, Y1 sm2P256FieldElement
@@ -499,23 +637,11 @@ func sm2P256Scalar(b *sm2P256FieldElement, a int) {
 }
 
 // (x3, y3, z3) = (x1, y1, z1) + (x2, y2, z2)
+// It runs in constant time and is not valid if either input is the point at
+// infinity or if both are equal, callers must handle those cases.
 func sm2P256PointAdd(x1, y1, z1, x2, y2, z2, x3, y3, z3 *sm2P256FieldElement) {
 	var u1, u2, z22, z12, z23, z13, s1, s2, h, h2, r, r2, tm sm2P256FieldElement
 
-	if sm2P256ToBig(z1).Sign() == 0 {
-		sm2P256Dup(x3, x2)
-		sm2P256Dup(y3, y2)
-		sm2P256Dup(z3, z2)
-		return
-	}
-
-	if sm2P256ToBig(z2).Sign() == 0 {
-		sm2P256Dup(x3, x1)
-		sm2P256Dup(y3, y1)
-		sm2P256Dup(z3, z1)
-		return
-	}
-
 	sm2P256Square(&z12, z1) // z12 = z1 ^ 2
 	sm2P256Square(&z22, z2) // z22 = z2 ^ 2
 
@@ -528,11 +654,6 @@ func sm2P256PointAdd(x1, y1, z1, x2, y2, z2, x3, y3, z3 *sm2P256FieldElement) {
 	sm2P256Mul(&s1, y1, &z23) // s1 = y1 * z2 ^ 3
 	sm2P256Mul(&s2, y2, &z13) // s2 = y2 * z1 ^ 3
 
-	if sm2P256ToBig(&u1).Cmp(sm2P256ToBig(&u2)) == 0 &&
-		sm2P256ToBig(&s1).Cmp(sm2P256ToBig(&s2)) == 0 {
-		sm2P256PointDouble(x1, y1, z1, x1, y1, z1)
-	}
-
 	sm2P256Sub(&h, &u2, &u1) // h = u2 - u1
 	sm2P256Sub(&r, &s2, &s1) // r = s2 - s1
 
@@ -792,6 +913,13 @@ func nonZeroToAllOnes(x uint32) uint32 {
 	return ((x - 1) >> 31) - 1
 }
 
+// lessThanToAllOnes returns 0xffffffff if a < b and 0 otherwise, in
+// constant time.
+func lessThanToAllOnes(a, b uint32) uint32 {
+	z := a - b
+	return -((z ^ ((a ^ b) & (b ^ z))) >> 31)
+}
+
 var sm2P256Carry = [8 * 9]uint32{
 	0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 	0x2, 0x0, 0x1FFFFF00, 0x7FF, 0x0, 0x0, 0x0, 0x2000000, 0x0,
@@ -852,75 +980,42 @@ func sm2P256ReduceDegree(a *sm2P256FieldElement, b *sm2P256LargeFieldElement) {
 	tmp[17] += uint32(b[16]>>32) << 3
 	tmp[17] += carry
 
+	// Montgomery elimination of terms. The borrows are propagated with
+	// masks instead of branches, and a zero word is eliminated like any
+	// other, so the time taken does not depend on the values.
 	for i := 0; ; i += 2 {
 
 		tmp[i+1] += tmp[i] >> 29
 		x = tmp[i] & bottom29Bits
 		tmp[i] = 0
-		if x > 0 {
-			set4 := uint32(0)
-			set7 := uint32(0)
-			xMask = nonZeroToAllOnes(x)
-			tmp[i+2] += (x << 7) & bottom29Bits
-			tmp[i+3] += x >> 22
-			if tmp[i+3] < 0x10000000 {
-				set4 = 1
-				tmp[i+3] += 0x10000000 & xMask
-				tmp[i+3] -= (x << 10) & bottom28Bits
-			} else {
-				tmp[i+3] -= (x << 10) & bottom28Bits
-			}
-			if tmp[i+4] < 0x20000000 {
-				tmp[i+4] += 0x20000000 & xMask
-				tmp[i+4] -= set4 // 借位
-				tmp[i+4] -= x >> 18
-				if tmp[i+5] < 0x10000000 {
-					tmp[i+5] += 0x10000000 & xMask
-					tmp[i+5] -= 1 // 借位
-					if tmp[i+6] < 0x20000000 {
-						set7 = 1
-						tmp[i+6] += 0x20000000 & xMask
-						tmp[i+6] -= 1 // 借位
-					} else {
-						tmp[i+6] -= 1 // 借位
-					}
-				} else {
-					tmp[i+5] -= 1
-				}
-			} else {
-				tmp[i+4] -= set4 // 借位
-				tmp[i+4] -= x >> 18
-			}
-			if tmp[i+7] < 0x10000000 {
-				tmp[i+7] += 0x10000000 & xMask
-				tmp[i+7] -= set7
-				tmp[i+7] -= (x << 24) & bottom28Bits
-				tmp[i+8] += (x << 28) & bottom29Bits
-				if tmp[i+8] < 0x20000000 {
-					tmp[i+8] += 0x20000000 & xMask
-					tmp[i+8] -= 1
-					tmp[i+8] -= x >> 4
-					tmp[i+9] += ((x >> 1) - 1) & xMask
-				} else {
-					tmp[i+8] -= 1
-					tmp[i+8] -= x >> 4
-					tmp[i+9] += (x >> 1) & xMask
-				}
-			} else {
-				tmp[i+7] -= set7 // 借位
-				tmp[i+7] -= (x << 24) & bottom28Bits
-				tmp[i+8] += (x << 28) & bottom29Bits
-				if tmp[i+8] < 0x20000000 {
-					tmp[i+8] += 0x20000000 & xMask
-					tmp[i+8] -= x >> 4
-					tmp[i+9] += ((x >> 1) - 1) & xMask
-				} else {
-					tmp[i+8] -= x >> 4
-					tmp[i+9] += (x >> 1) & xMask
-				}
-			}
-
-		}
+		xMask = nonZeroToAllOnes(x)
+		tmp[i+2] += (x << 7) & bottom29Bits
+		tmp[i+3] += x >> 22
+		c3 := lessThanToAllOnes(tmp[i+3], 0x10000000) & xMask
+		set4 := c3 & 1
+		tmp[i+3] += 0x10000000 & c3
+		tmp[i+3] -= (x << 10) & bottom28Bits
+		c4 := lessThanToAllOnes(tmp[i+4], 0x20000000) & xMask
+		tmp[i+4] += 0x20000000 & c4
+		tmp[i+4] -= set4 // 借位
+		tmp[i+4] -= x >> 18
+		c5 := lessThanToAllOnes(tmp[i+5], 0x10000000) & c4
+		tmp[i+5] += 0x10000000 & c5
+		tmp[i+5] -= 1 & c4 // 借位
+		c6 := lessThanToAllOnes(tmp[i+6], 0x20000000) & c5
+		set7 := c6 & 1
+		tmp[i+6] += 0x20000000 & c6
+		tmp[i+6] -= 1 & c5 // 借位
+		c7 := lessThanToAllOnes(tmp[i+7], 0x10000000) & xMask
+		tmp[i+7] += 0x10000000 & c7
+		tmp[i+7] -= set7 // 借位
+		tmp[i+7] -= (x << 24) & bottom28Bits
+		tmp[i+8] += (x << 28) & bottom29Bits
+		c8 := lessThanToAllOnes(tmp[i+8], 0x20000000) & xMask
+		tmp[i+8] += 0x20000000 & c8
+		tmp[i+8] -= 1 & c7 // 借位
+		tmp[i+8] -= x >> 4
+		tmp[i+9] += ((x >> 1) - (1 & c8)) & xMask
 
 		if i+1 == 9 {
 			break
@@ -929,61 +1024,34 @@ func sm2P256ReduceDegree(a *sm2P256FieldElement, b *sm2P256LargeFieldElement) {
 		tmp[i+2] += tmp[i+1] >> 28
 		x = tmp[i+1] & bottom28Bits
 		tmp[i+1] = 0
-		if x > 0 {
-			set5 := uint32(0)
-			set8 := uint32(0)
-			set9 := uint32(0)
-			xMask = nonZeroToAllOnes(x)
-			tmp[i+3] += (x << 7) & bottom28Bits
-			tmp[i+4] += x >> 21
-			if tmp[i+4] < 0x20000000 {
-				set5 = 1
-				tmp[i+4] += 0x20000000 & xMask
-				tmp[i+4] -= (x << 11) & bottom29Bits
-			} else {
-				tmp[i+4] -= (x << 11) & bottom29Bits
-			}
-			if tmp[i+5] < 0x10000000 {
-				tmp[i+5] += 0x10000000 & xMask
-				tmp[i+5] -= set5 // 借位
-				tmp[i+5] -= x >> 18
-				if tmp[i+6] < 0x20000000 {
-					tmp[i+6] += 0x20000000 & xMask
-					tmp[i+6] -= 1 // 借位
-					if tmp[i+7] < 0x10000000 {
-						set8 = 1
-						tmp[i+7] += 0x10000000 & xMask
-						tmp[i+7] -= 1 // 借位
-					} else {
-						tmp[i+7] -= 1 // 借位
-					}
-				} else {
-					tmp[i+6] -= 1 // 借位
-				}
-			} else {
-				tmp[i+5] -= set5 // 借位
-				tmp[i+5] -= x >> 18
-			}
-			if tmp[i+8] < 0x20000000 {
-				set9 = 1
-				tmp[i+8] += 0x20000000 & xMask
-				tmp[i+8] -= set8
-				tmp[i+8] -= (x << 25) & bottom29Bits
-			} else {
-				tmp[i+8] -= set8
-				tmp[i+8] -= (x << 25) & bottom29Bits
-			}
-			if tmp[i+9] < 0x10000000 {
-				tmp[i+9] += 0x10000000 & xMask
-				tmp[i+9] -= set9 // 借位
-				tmp[i+9] -= x >> 4
-				tmp[i+10] += (x - 1) & xMask
-			} else {
-				tmp[i+9] -= set9 // 借位
-				tmp[i+9] -= x >> 4
-				tmp[i+10] += x & xMask
-			}
-		}
+		xMask = nonZeroToAllOnes(x)
+		tmp[i+3] += (x << 7) & bottom28Bits
+		tmp[i+4] += x >> 21
+		c4 = lessThanToAllOnes(tmp[i+4], 0x20000000) & xMask
+		set5 := c4 & 1
+		tmp[i+4] += 0x20000000 & c4
+		tmp[i+4] -= (x << 11) & bottom29Bits
+		c5 = lessThanToAllOnes(tmp[i+5], 0x10000000) & xMask
+		tmp[i+5] += 0x10000000 & c5
+		tmp[i+5] -= set5 // 借位
+		tmp[i+5] -= x >> 18
+		c6 = lessThanToAllOnes(tmp[i+6], 0x20000000) & c5
+		tmp[i+6] += 0x20000000 & c6
+		tmp[i+6] -= 1 & c5 // 借位
+		c7 = lessThanToAllOnes(tmp[i+7], 0x10000000) & c6
+		set8 := c7 & 1
+		tmp[i+7] += 0x10000000 & c7
+		tmp[i+7] -= 1 & c6 // 借位
+		c8 = lessThanToAllOnes(tmp[i+8], 0x20000000) & xMask
+		set9 := c8 & 1
+		tmp[i+8] += 0x20000000 & c8
+		tmp[i+8] -= set8 // 借位
+		tmp[i+8] -= (x << 25) & bottom29Bits
+		c9 := lessThanToAllOnes(tmp[i+9], 0x10000000) & xMask
+		tmp[i+9] += 0x10000000 & c9
+		tmp[i+9] -= set9 // 借位
+		tmp[i+9] -= x >> 4
+		tmp[i+10] += (x - (1 & c9)) & xMask
 	}
 
 	carry = uint32(0)
@@ -0,0 +1,411 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// PKCS#12 (RFC 7292) decoding of an SM2 key and its certificate
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+	"unicode/utf16"
+
+	"github.com/tjfoc/gmsm/sm3"
+	"github.com/tjfoc/gmsm/sm4"
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+
+	oidSHA1    = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSM3Hash = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 401} // as OpenSSL writes it
+
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidSM4CBC    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 104, 2}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData `asn1:"optional"`
+}
+
+// An explicitly tagged asn1.RawValue keeps the [0] wrapper, so Bytes of
+// Content and of pkcs12SafeBag.Value is the DER of the wrapped element.
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo pkcs12EncryptedContentInfo
+}
+
+type pkcs12EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type pkcs12CertBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// pkcs12PBKDF2Params is Pkdf2Params with the optional members RFC 8018
+// allows, as PKCS#12 files often omit the PRF to mean hmacWithSHA1.
+type pkcs12PBKDF2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pkcs12PBES2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// DecodePKCS12 extracts the SM2 private key and its certificate from the
+// PKCS#12 (.pfx) data protected by password. The MAC, when present, is
+// verified first. Bags may be encrypted with PBES2 (PBKDF2 with AES-CBC or
+// SM4-CBC) or with pbeWithSHAAnd3-KeyTripleDES-CBC; the RC2 schemes of old
+// files are not supported. Of several certificates, the one holding the
+// public key of the private key is returned.
+func DecodePKCS12(data []byte, password string) (*PrivateKey, *Certificate, error) {
+	var pfx pfxPdu
+
+	rest, err := asn1.Unmarshal(data, &pfx)
+	if err != nil {
+		return nil, nil, errors.New("pkcs12: " + err.Error())
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("pkcs12: trailing data after PFX")
+	}
+	if pfx.Version != 3 {
+		return nil, nil, errors.New("pkcs12: unsupported version")
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, nil, errors.New("pkcs12: only password integrity mode is supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, errors.New("pkcs12: " + err.Error())
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) != 0 {
+		if err := verifyPKCS12MAC(&pfx.MacData, authSafe, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var safes []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authSafe, &safes); err != nil {
+		return nil, nil, errors.New("pkcs12: " + err.Error())
+	}
+	var priv *PrivateKey
+	var certs []*Certificate
+	for _, ci := range safes {
+		var bagsDER []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &bagsDER); err != nil {
+				return nil, nil, errors.New("pkcs12: " + err.Error())
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed pkcs12EncryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, errors.New("pkcs12: " + err.Error())
+			}
+			eci := ed.EncryptedContentInfo
+			if bagsDER, err = pkcs12Decrypt(eci.ContentEncryptionAlgorithm, eci.EncryptedContent, password); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, errors.New("pkcs12: only data and encrypted data contents are supported")
+		}
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(bagsDER, &bags); err != nil {
+			return nil, nil, errors.New("pkcs12: " + err.Error())
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.Id.Equal(oidKeyBag), bag.Id.Equal(oidPKCS8ShroudedKeyBag):
+				if priv != nil {
+					return nil, nil, errors.New("pkcs12: more than one private key")
+				}
+				if priv, err = pkcs12PrivateKey(&bag, password); err != nil {
+					return nil, nil, err
+				}
+			case bag.Id.Equal(oidCertBag):
+				var cb pkcs12CertBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, errors.New("pkcs12: " + err.Error())
+				}
+				if !cb.Id.Equal(oidCertTypeX509) {
+					continue
+				}
+				cert, err := ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, err
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if priv == nil {
+		return nil, nil, errors.New("pkcs12: no private key")
+	}
+	for _, cert := range certs {
+		if pub, err := ParseSm2PublicKey(cert.RawSubjectPublicKeyInfo); err == nil && pub.Equal(&priv.PublicKey) {
+			return priv, cert, nil
+		}
+	}
+	return nil, nil, errors.New("pkcs12: no certificate for the private key")
+}
+
+func pkcs12PrivateKey(bag *pkcs12SafeBag, password string) (*PrivateKey, error) {
+	if bag.Id.Equal(oidKeyBag) {
+		return ParsePKCS8UnecryptedPrivateKey(bag.Value.Bytes)
+	}
+	var info pkcs12EncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+		return nil, errors.New("pkcs12: " + err.Error())
+	}
+	der, err := pkcs12Decrypt(info.Algorithm, info.EncryptedData, password)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePKCS8UnecryptedPrivateKey(der)
+}
+
+func verifyPKCS12MAC(md *pkcs12MacData, content []byte, password string) error {
+	h, err := pkcs12Hash(md.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(h, bmpPassword(password), md.MacSalt, md.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return errors.New("pkcs12: MAC verification failed, the password may be incorrect")
+	}
+	return nil
+}
+
+func pkcs12Hash(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1), oid.Equal(oidKEYSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidSHA256), oid.Equal(oidKEYSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidSHA512), oid.Equal(oidKEYSHA512):
+		return sha512.New, nil
+	case oid.Equal(oidSM3Hash), oid.Equal(oidSM3):
+		return sm3.New, nil
+	}
+	return nil, errors.New("pkcs12: unsupported hash algorithm " + oid.String())
+}
+
+// pkcs12Decrypt decrypts data encrypted with the password based scheme alg
+// and removes the padding.
+func pkcs12Decrypt(alg pkix.AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("pkcs12: " + err.Error())
+		}
+		pwd := bmpPassword(password)
+		key := pkcs12KDF(sha1.New, pwd, params.Salt, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, pwd, params.Salt, params.Iterations, 2, 8)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pkcs12PBES2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("pkcs12: " + err.Error())
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, errors.New("pkcs12: only PBKDF2 is supported with PBES2")
+		}
+		var kdfParams pkcs12PBKDF2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, errors.New("pkcs12: " + err.Error())
+		}
+		prf := sha1.New
+		if len(kdfParams.Prf.Algorithm) != 0 {
+			var err error
+			if prf, err = pkcs12Hash(kdfParams.Prf.Algorithm); err != nil {
+				return nil, err
+			}
+		}
+		enc := params.EncryptionScheme
+		var keyLen int
+		newCipher := aes.NewCipher
+		switch {
+		case enc.Algorithm.Equal(oidAES128CBC):
+			keyLen = 16
+		case enc.Algorithm.Equal(oidAES192CBC):
+			keyLen = 24
+		case enc.Algorithm.Equal(oidAES256CBC):
+			keyLen = 32
+		case enc.Algorithm.Equal(oidSM4CBC):
+			keyLen, newCipher = 16, sm4.NewCipher
+		default:
+			return nil, errors.New("pkcs12: unsupported encryption algorithm " + enc.Algorithm.String())
+		}
+		if _, err := asn1.Unmarshal(enc.Parameters.FullBytes, &iv); err != nil {
+			return nil, errors.New("pkcs12: " + err.Error())
+		}
+		key := pbkdf([]byte(password), kdfParams.Salt, kdfParams.IterationCount, keyLen, prf)
+		var err error
+		if block, err = newCipher(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("pkcs12: unsupported encryption algorithm " + alg.Algorithm.String())
+	}
+
+	bs := block.BlockSize()
+	if len(iv) != bs || len(data) == 0 || len(data)%bs != 0 {
+		return nil, errors.New("pkcs12: invalid encrypted data")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	n := int(out[len(out)-1])
+	if n == 0 || n > bs {
+		return nil, errors.New("pkcs12: decryption failed, the password may be incorrect")
+	}
+	for _, b := range out[len(out)-n:] {
+		if int(b) != n {
+			return nil, errors.New("pkcs12: decryption failed, the password may be incorrect")
+		}
+	}
+	return out[:len(out)-n], nil
+}
+
+// bmpPassword encodes password as the NUL terminated big endian UTF-16
+// string the PKCS#12 key derivation takes.
+func bmpPassword(password string) []byte {
+	u := utf16.Encode([]rune(password))
+	b := make([]byte, 0, 2*len(u)+2)
+	for _, c := range u {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF is the key derivation of RFC 7292 appendix B.2, deriving size
+// bytes for the purpose id: 1 for keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(h func() hash.Hash, password, salt []byte, iter int, id byte, size int) []byte {
+	v := h().BlockSize()
+	u := h().Size()
+
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	I := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		A := h()
+		A.Write(D)
+		A.Write(I)
+		Ai := A.Sum(nil)
+		for j := 1; j < iter; j++ {
+			A = h()
+			A.Write(Ai)
+			Ai = A.Sum(nil)
+		}
+		out = append(out, Ai...)
+		if len(out) >= size {
+			break
+		}
+		// I_j = (I_j + B + 1) mod 2^(8v) for each v byte block I_j of I
+		B := make([]byte, v)
+		for i := range B {
+			B[i] = Ai[i%u]
+		}
+		for j := 0; j < len(I); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(I[j+k]) + int(B[k])
+				I[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+	return out[:size]
+}
@@ -0,0 +1,188 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// Detached SM2 signatures in the SignedData structure of GM/T 0010, which
+// is PKCS#7 (RFC 2315) with SM2 and SM3 and its own content type OIDs.
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+var (
+	oidSM2Data       = asn1.ObjectIdentifier{1, 2, 156, 10197, 6, 1, 4, 2, 1}
+	oidSM2SignedData = asn1.ObjectIdentifier{1, 2, 156, 10197, 6, 1, 4, 2, 2}
+
+	oidSignedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	// sm2-1, the signature algorithm that GM/T 0010 names for SignerInfo
+	oidSM2Sign = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301, 1}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// SignPKCS7Detached signs content with priv and returns a DER encoded
+// ContentInfo holding a GM/T 0010 SignedData without the content. The
+// signature is SM2 with SM3 over ZA || content with the default user ID
+// and is labelled sm2-1 as GM/T 0010 requires; cert is the certificate of
+// priv and is embedded so that verifiers can find the key.
+func SignPKCS7Detached(content []byte, cert *Certificate, priv *PrivateKey) ([]byte, error) {
+	if nilPrivateKey(priv) {
+		return nil, ErrNilKey
+	}
+	if cert == nil {
+		return nil, errors.New("x509: nil certificate")
+	}
+	pub, err := ParseSm2PublicKey(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		return nil, errors.New("x509: private key does not match public key of the certificate")
+	}
+	sig, err := SignWithUID(priv, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	sm3Algo := pkix.AlgorithmIdentifier{Algorithm: oidSM3Hash}
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sm3Algo},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidSM2Data},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      cert.Raw,
+		},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           sm3Algo,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSM2Sign},
+			EncryptedDigest:           sig,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSM2SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// VerifyPKCS7Detached verifies a detached SignedData made by
+// SignPKCS7Detached, or by another implementation of GM/T 0010 or PKCS#7
+// with SM2, over content. Every signer must be SM2 with SM3, without
+// authenticated attributes, and have its certificate embedded. It returns
+// the certificate of the first signer; the caller must check it, for
+// example with Certificate.Verify.
+func VerifyPKCS7Detached(der, content []byte) (*Certificate, error) {
+	var ci pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("x509: trailing data after SignedData")
+	}
+	if !ci.ContentType.Equal(oidSM2SignedData) && !ci.ContentType.Equal(oidSignedDataContentType) {
+		return nil, UnsupportedAlgorithmError{"content type", ci.ContentType}
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.ContentInfo.Content.Bytes) != 0 {
+		return nil, errors.New("x509: SignedData is not detached")
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, errors.New("x509: SignedData has no signers")
+	}
+	certs, err := ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	var first *Certificate
+	for _, si := range sd.SignerInfos {
+		if !si.DigestAlgorithm.Algorithm.Equal(oidSM3Hash) {
+			return nil, UnsupportedAlgorithmError{"digest algorithm", si.DigestAlgorithm.Algorithm}
+		}
+		if algo := si.DigestEncryptionAlgorithm.Algorithm; !algo.Equal(oidSignatureSM2WithSM3) && !algo.Equal(oidSM2Sign) {
+			return nil, UnsupportedAlgorithmError{"signature algorithm", algo}
+		}
+		if len(si.AuthenticatedAttributes.FullBytes) != 0 {
+			return nil, errors.New("x509: authenticated attributes are not supported")
+		}
+		cert := pkcs7FindCertificate(certs, &si.IssuerAndSerialNumber)
+		if cert == nil {
+			return nil, errors.New("x509: certificate of signer not found")
+		}
+		pub, err := ParseSm2PublicKey(cert.RawSubjectPublicKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		if !VerifyWithUID(pub, content, si.EncryptedDigest, nil) {
+			return nil, errors.New("x509: SM2 verification failure")
+		}
+		if first == nil {
+			first = cert
+		}
+	}
+	return first, nil
+}
+
+func pkcs7FindCertificate(certs []*Certificate, ias *pkcs7IssuerAndSerial) *Certificate {
+	for _, cert := range certs {
+		if cert.SerialNumber.Cmp(ias.SerialNumber) == 0 &&
+			string(cert.RawIssuer) == string(ias.Issuer.FullBytes) {
+			return cert
+		}
+	}
+	return nil
+}
@@ -16,8 +16,11 @@ limitations under the License.
 package sm2
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/des"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/md5"
@@ -25,15 +28,24 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/tjfoc/gmsm/sm3"
 )
 
 /*
@@ -52,10 +64,22 @@ var (
 
 	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
 	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	// des-EDE3-CBC is only accepted when reading legacy keys.
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
 
 	oidSM2 = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
 )
 
+// defaultIterationCount is the PBKDF2 iteration count used when encrypting
+// private keys, the count OWASP recommends for PBKDF2-HMAC-SHA256; the PRF
+// stays HMAC-SHA1 so that existing readers of the keys still work. The
+// parse path reads the count from the key, so keys written with the old
+// default of 2048 still load.
+const defaultIterationCount = 600000
+
+// iterationCount is the count used, which tests lower to keep them fast.
+var iterationCount = defaultIterationCount
+
 // reference to https://www.rfc-editor.org/rfc/rfc5958.txt
 type PrivateKeyInfo struct {
 	Version             int // v1 or v2
@@ -99,6 +123,10 @@ type Pkdf2Params struct {
 	Prf            pkix.AlgorithmIdentifier
 }
 
+// ecPrivKeyVersion is the version of the ECPrivateKey structure of
+// RFC 5915 / SEC 1, the only one defined.
+const ecPrivKeyVersion = 1
+
 type sm2PrivateKey struct {
 	Version       int
 	PrivateKey    []byte
@@ -106,12 +134,22 @@ type sm2PrivateKey struct {
 	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
 }
 
+// pkcs8 is the OneAsymmetricKey of RFC 5958, which is PrivateKeyInfo of
+// PKCS#8 when the version is v1.
 type pkcs8 struct {
 	Version    int
 	Algo       pkix.AlgorithmIdentifier
 	PrivateKey []byte
+	Attributes asn1.RawValue  `asn1:"optional,tag:0"`
+	PublicKey  asn1.BitString `asn1:"optional,tag:1"` // v2 only
 }
 
+// Versions of OneAsymmetricKey.
+const (
+	pkcs8V1 = 0
+	pkcs8V2 = 1
+)
+
 // copy from crypto/pbkdf2.go
 func pbkdf(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
 	prf := hmac.New(h, password)
@@ -150,6 +188,18 @@ func pbkdf(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
 	return dk[:keyLen]
 }
 
+// UnsupportedAlgorithmError is returned when a key, or the encryption of a
+// key, being parsed names an algorithm this package does not support. OID
+// is the identifier that was found.
+type UnsupportedAlgorithmError struct {
+	Kind string // what OID identifies, e.g. "KDF" or "named curve"
+	OID  asn1.ObjectIdentifier
+}
+
+func (e UnsupportedAlgorithmError) Error() string {
+	return "x509: unsupported " + e.Kind + " OID " + e.OID.String()
+}
+
 func ParseSm2PublicKey(der []byte) (*PublicKey, error) {
 	var pubkey pkixPublicKey
 
@@ -157,10 +207,24 @@ func ParseSm2PublicKey(der []byte) (*PublicKey, error) {
 		return nil, err
 	}
 	if !reflect.DeepEqual(pubkey.Algo.Algorithm, oidSM2) {
-		return nil, errors.New("x509: not sm2 elliptic curve")
+		return nil, UnsupportedAlgorithmError{"public key algorithm", pubkey.Algo.Algorithm}
+	}
+	curve, err := sm2CurveFromParameters(pubkey.Algo.Parameters.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	point := pubkey.BitString.Bytes
+	if len(point) == 33 && (point[0] == 2 || point[0] == 3) {
+		pub := Decompress(point)
+		if pub == nil {
+			return nil, errors.New("x509: invalid sm2 public key point")
+		}
+		return pub, nil
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("x509: invalid sm2 public key point")
 	}
-	curve := P256Sm2()
-	x, y := elliptic.Unmarshal(curve, pubkey.BitString.Bytes)
 	pub := PublicKey{
 		Curve: curve,
 		X:     x,
@@ -170,26 +234,135 @@ func ParseSm2PublicKey(der []byte) (*PublicKey, error) {
 }
 
 func MarshalSm2PublicKey(key *PublicKey) ([]byte, error) {
+	return marshalSm2PublicKey(key, false)
+}
+
+// MarshalSm2PublicKeyCompressed is like MarshalSm2PublicKey but encodes the
+// point in the 33-byte SEC1 compressed form, which some smart cards
+// require. ParseSm2PublicKey reads both forms.
+func MarshalSm2PublicKeyCompressed(key *PublicKey) ([]byte, error) {
+	return marshalSm2PublicKey(key, true)
+}
+
+func marshalSm2PublicKey(key *PublicKey, compressed bool) ([]byte, error) {
 	var r pkixPublicKey
 	var algo pkix.AlgorithmIdentifier
 
+	if nilPublicKey(key) {
+		return nil, ErrNilKey
+	}
 	algo.Algorithm = oidSM2
 	algo.Parameters.Class = 0
 	algo.Parameters.Tag = 6
 	algo.Parameters.IsCompound = false
 	algo.Parameters.FullBytes = []byte{6, 8, 42, 129, 28, 207, 85, 1, 130, 45} // asn1.Marshal(asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301})
 	r.Algo = algo
-	r.BitString = asn1.BitString{Bytes: elliptic.Marshal(key.Curve, key.X, key.Y)}
+	if compressed {
+		point := append([]byte{2 + byte(key.Y.Bit(0))}, bigIntTo32Bytes(key.X)...)
+		r.BitString = asn1.BitString{Bytes: point}
+	} else {
+		r.BitString = asn1.BitString{Bytes: elliptic.Marshal(key.Curve, key.X, key.Y)}
+	}
 	return asn1.Marshal(r)
 }
 
+// PublicKeyFingerprint returns the SM3 hash of the DER SubjectPublicKeyInfo
+// of pub, or nil if pub is not a valid key.
+func PublicKeyFingerprint(pub *PublicKey) []byte {
+	der, err := MarshalSm2PublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	return sm3.Sm3Sum(der)
+}
+
+// PublicKeyFingerprintHex returns PublicKeyFingerprint as a hex string.
+func PublicKeyFingerprintHex(pub *PublicKey) string {
+	return hex.EncodeToString(PublicKeyFingerprint(pub))
+}
+
+// PublicKeyToHex returns pub as the hex of the uncompressed point
+// 04 || X || Y, as printed by OpenSSL, or "" if pub is not a valid key.
+func PublicKeyToHex(pub *PublicKey) string {
+	if nilPublicKey(pub) {
+		return ""
+	}
+	return hex.EncodeToString(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+}
+
+// PublicKeyFromHex parses the hex of an uncompressed (04 || X || Y) or
+// SEC1 compressed (02 or 03 || X) point on the SM2 curve.
+func PublicKeyFromHex(s string) (*PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	var pub *PublicKey
+	switch {
+	case len(b) == 65 && b[0] == 4:
+		x, y := elliptic.Unmarshal(P256Sm2(), b)
+		if x != nil {
+			pub = &PublicKey{Curve: P256Sm2(), X: x, Y: y}
+		}
+	case len(b) == 33 && (b[0] == 2 || b[0] == 3):
+		pub = Decompress(b)
+	default:
+		return nil, errors.New("SM2: public key hex is neither an uncompressed nor a compressed point")
+	}
+	if pub == nil {
+		return nil, errors.New("SM2: public key hex is not a point on the curve")
+	}
+	if err := ValidatePublicKey(pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// wirePrefix names the key type in the one line format of MarshalWire.
+const wirePrefix = "sm2-256"
+
+// MarshalWire returns pub on one line, in the spirit of an SSH
+// authorized_keys entry: "sm2-256 " followed by the standard base64 of the
+// SEC1 compressed point, or "" if pub is not a valid key. It can be used
+// as a plain YAML scalar without quoting.
+func MarshalWire(pub *PublicKey) string {
+	if ValidatePublicKey(pub) != nil {
+		return ""
+	}
+	return wirePrefix + " " + base64.StdEncoding.EncodeToString(CompressPoint(pub.X, pub.Y))
+}
+
+// ParseWire parses a key written by MarshalWire. Surrounding white space
+// is ignored, and so is a comment after the key, as in authorized_keys.
+func ParseWire(s string) (*PublicKey, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || fields[0] != wirePrefix {
+		return nil, errors.New("SM2: public key is not in " + wirePrefix + " format")
+	}
+	b, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	x, y, err := DecompressPoint(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKey{Curve: P256Sm2(), X: x, Y: y}, nil
+}
+
 func ParseSm2PrivateKey(der []byte) (*PrivateKey, error) {
-	var privKey sm2PrivateKey
+	var privKey ecPrivateKey
 
 	if _, err := asn1.Unmarshal(der, &privKey); err != nil {
 		return nil, errors.New("x509: failed to parse SM2 private key: " + err.Error())
 	}
-	curve := P256Sm2()
+	if privKey.Version != ecPrivKeyVersion {
+		return nil, fmt.Errorf("x509: unknown EC private key version %d", privKey.Version)
+	}
+	curve, err := sm2CurveFromParameters(privKey.Parameters.Bytes)
+	if err != nil {
+		return nil, err
+	}
 	k := new(big.Int).SetBytes(privKey.PrivateKey)
 	curveOrder := curve.Params().N
 	if k.Cmp(curveOrder) >= 0 {
@@ -217,12 +390,83 @@ func ParsePKCS8UnecryptedPrivateKey(der []byte) (*PrivateKey, error) {
 		return nil, err
 	}
 	if !reflect.DeepEqual(privKey.Algo.Algorithm, oidSM2) {
-		return nil, errors.New("x509: not sm2 elliptic curve")
+		return nil, UnsupportedAlgorithmError{"private key algorithm", privKey.Algo.Algorithm}
+	}
+	if privKey.Version != pkcs8V1 && privKey.Version != pkcs8V2 {
+		return nil, fmt.Errorf("x509: unknown PKCS#8 version %d", privKey.Version)
+	}
+	if _, err := sm2CurveFromParameters(privKey.Algo.Parameters.FullBytes); err != nil {
+		return nil, err
+	}
+	priv, err := ParseSm2PrivateKey(privKey.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if point := privKey.PublicKey.Bytes; len(point) != 0 {
+		var x, y *big.Int
+		if len(point) == 33 {
+			x, y, err = DecompressPoint(point)
+		} else if x, y = elliptic.Unmarshal(priv.Curve, point); x == nil {
+			err = errors.New("x509: invalid sm2 public key point")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if x.Cmp(priv.X) != 0 || y.Cmp(priv.Y) != 0 {
+			return nil, errors.New("x509: public key does not match private key")
+		}
+	}
+	return priv, nil
+}
+
+// EncryptOptions customizes how private keys are encrypted and decrypted.
+type EncryptOptions struct {
+	// NewCipher creates the AES block cipher used for the key encryption,
+	// for example one backed by a hardware or FIPS validated module. If
+	// nil, aes.NewCipher is used.
+	NewCipher func(key []byte) (cipher.Block, error)
+
+	// Rand is the source of the salt and IV. If nil, crypto/rand.Reader
+	// is used.
+	Rand io.Reader
+
+	// SaltLen is the length of the PBKDF2 salt in bytes, at least 8 as
+	// RFC 8018 requires. If zero, 8 is used for compatibility with keys
+	// written before it was configurable; 16 is recommended.
+	SaltLen int
+}
+
+func (opts *EncryptOptions) newCipher(key []byte) (cipher.Block, error) {
+	if opts == nil || opts.NewCipher == nil {
+		return aes.NewCipher(key)
+	}
+	return opts.NewCipher(key)
+}
+
+func (opts *EncryptOptions) saltLen() (int, error) {
+	if opts == nil || opts.SaltLen == 0 {
+		return 8, nil
+	}
+	if opts.SaltLen < 8 {
+		return 0, errors.New("x509: salt shorter than 8 bytes")
+	}
+	return opts.SaltLen, nil
+}
+
+func (opts *EncryptOptions) rand() io.Reader {
+	if opts == nil || opts.Rand == nil {
+		return rand.Reader
 	}
-	return ParseSm2PrivateKey(privKey.PrivateKey)
+	return opts.Rand
 }
 
 func ParsePKCS8EcryptedPrivateKey(der, pwd []byte) (*PrivateKey, error) {
+	return ParsePKCS8EcryptedPrivateKeyWithOptions(der, pwd, nil)
+}
+
+// ParsePKCS8EcryptedPrivateKeyWithOptions is like
+// ParsePKCS8EcryptedPrivateKey but decrypts with the cipher from opts.
+func ParsePKCS8EcryptedPrivateKeyWithOptions(der, pwd []byte, opts *EncryptOptions) (*PrivateKey, error) {
 	var keyInfo EncryptedPrivateKeyInfo
 
 	_, err := asn1.Unmarshal(der, &keyInfo)
@@ -230,17 +474,22 @@ func ParsePKCS8EcryptedPrivateKey(der, pwd []byte) (*PrivateKey, error) {
 		return nil, errors.New("x509: unknown format")
 	}
 	if !reflect.DeepEqual(keyInfo.EncryptionAlgorithm.IdPBES2, oidPBES2) {
-		return nil, errors.New("x509: only support PBES2")
+		return nil, UnsupportedAlgorithmError{"key encryption scheme", keyInfo.EncryptionAlgorithm.IdPBES2}
 	}
 	encryptionScheme := keyInfo.EncryptionAlgorithm.Pbes2Params.EncryptionScheme
 	keyDerivationFunc := keyInfo.EncryptionAlgorithm.Pbes2Params.KeyDerivationFunc
 	if !reflect.DeepEqual(keyDerivationFunc.IdPBKDF2, oidPBKDF2) {
-		return nil, errors.New("x509: only support PBKDF2")
+		return nil, UnsupportedAlgorithmError{"KDF", keyDerivationFunc.IdPBKDF2}
 	}
 	pkdf2Params := keyDerivationFunc.Pkdf2Params
-	if !reflect.DeepEqual(encryptionScheme.EncryAlgo, oidAES128CBC) &&
-		!reflect.DeepEqual(encryptionScheme.EncryAlgo, oidAES256CBC) {
-		return nil, errors.New("x509: unknow encryption algorithm")
+	keyLen, newCipher := 32, opts.newCipher
+	switch {
+	case encryptionScheme.EncryAlgo.Equal(oidAES128CBC),
+		encryptionScheme.EncryAlgo.Equal(oidAES256CBC):
+	case encryptionScheme.EncryAlgo.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, UnsupportedAlgorithmError{"cipher", encryptionScheme.EncryAlgo}
 	}
 	iv := encryptionScheme.IV
 	salt := pkdf2Params.Salt
@@ -249,24 +498,27 @@ func ParsePKCS8EcryptedPrivateKey(der, pwd []byte) (*PrivateKey, error) {
 	var key []byte
 	switch {
 	case pkdf2Params.Prf.Algorithm.Equal(oidKEYMD5):
-		key = pbkdf(pwd, salt, iter, 32, md5.New)
+		key = pbkdf(pwd, salt, iter, keyLen, md5.New)
 		break
 	case pkdf2Params.Prf.Algorithm.Equal(oidKEYSHA1):
-		key = pbkdf(pwd, salt, iter, 32, sha1.New)
+		key = pbkdf(pwd, salt, iter, keyLen, sha1.New)
 		break
 	case pkdf2Params.Prf.Algorithm.Equal(oidKEYSHA256):
-		key = pbkdf(pwd, salt, iter, 32, sha256.New)
+		key = pbkdf(pwd, salt, iter, keyLen, sha256.New)
 		break
 	case pkdf2Params.Prf.Algorithm.Equal(oidKEYSHA512):
-		key = pbkdf(pwd, salt, iter, 32, sha512.New)
+		key = pbkdf(pwd, salt, iter, keyLen, sha512.New)
 		break
 	default:
-		return nil, errors.New("x509: unknown hash algorithm")
+		return nil, UnsupportedAlgorithmError{"PRF", pkdf2Params.Prf.Algorithm}
 	}
-	block, err := aes.NewCipher(key)
+	block, err := newCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	if len(iv) != block.BlockSize() || len(encryptedKey)%block.BlockSize() != 0 {
+		return nil, errors.New("x509: invalid encrypted private key")
+	}
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(encryptedKey, encryptedKey)
 	rKey, err := ParsePKCS8UnecryptedPrivateKey(encryptedKey)
@@ -284,35 +536,247 @@ func ParsePKCS8PrivateKey(der, pwd []byte) (*PrivateKey, error) {
 }
 
 func MarshalSm2UnecryptedPrivateKey(key *PrivateKey) ([]byte, error) {
+	return MarshalSm2UnecryptedPrivateKeyWithOptions(key, nil)
+}
+
+// PrivateKeyOptions selects the optional fields of the SEC 1 ECPrivateKey
+// written inside a PKCS#8 private key. The zero value, like a nil
+// *PrivateKeyOptions, writes both.
+type PrivateKeyOptions struct {
+	// OmitPublicKey leaves out the public key, which readers recompute
+	// from the private scalar.
+	OmitPublicKey bool
+	// OmitCurveOID leaves out the named curve OID, which the PKCS#8
+	// algorithm identifier repeats.
+	OmitCurveOID bool
+}
+
+// MarshalSm2UnecryptedPrivateKeyWithOptions is like
+// MarshalSm2UnecryptedPrivateKey but can leave out the optional fields,
+// for devices that only have room for the bare scalar.
+func MarshalSm2UnecryptedPrivateKeyWithOptions(key *PrivateKey, opts *PrivateKeyOptions) ([]byte, error) {
 	var r pkcs8
 	var priv sm2PrivateKey
 	var algo pkix.AlgorithmIdentifier
 
+	if nilPrivateKey(key) {
+		return nil, ErrNilKey
+	}
 	algo.Algorithm = oidSM2
 	algo.Parameters.Class = 0
 	algo.Parameters.Tag = 6
 	algo.Parameters.IsCompound = false
 	algo.Parameters.FullBytes = []byte{6, 8, 42, 129, 28, 207, 85, 1, 130, 45} // asn1.Marshal(asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301})
-	priv.Version = 1
-	priv.NamedCurveOID = oidNamedCurveP256SM2
-	priv.PublicKey = asn1.BitString{Bytes: elliptic.Marshal(key.Curve, key.X, key.Y)}
-	priv.PrivateKey = key.D.Bytes()
+	priv.Version = ecPrivKeyVersion
+	if opts == nil || !opts.OmitCurveOID {
+		priv.NamedCurveOID = oidNamedCurveP256SM2
+	}
+	if opts == nil || !opts.OmitPublicKey {
+		priv.PublicKey = asn1.BitString{Bytes: elliptic.Marshal(key.Curve, key.X, key.Y)}
+	}
+	priv.PrivateKey = bigIntTo32Bytes(key.D) // RFC 5915, fixed length
 	r.Version = 0
 	r.Algo = algo
 	r.PrivateKey, _ = asn1.Marshal(priv)
 	return asn1.Marshal(r)
 }
 
+// ecParameters is the explicit form of the domain parameters of SEC 1
+// section C.2, used instead of a named curve OID.
+type ecParameters struct {
+	Version  int
+	FieldID  ecFieldID
+	Curve    ecCurve
+	Base     []byte // uncompressed point
+	Order    *big.Int
+	Cofactor int `asn1:"optional"`
+}
+
+type ecFieldID struct {
+	FieldType asn1.ObjectIdentifier
+	Prime     *big.Int
+}
+
+type ecCurve struct {
+	A, B []byte
+	Seed asn1.BitString `asn1:"optional"`
+}
+
+var oidPrimeField = asn1.ObjectIdentifier{1, 2, 840, 10045, 1, 1}
+
+// sm2ECParameters returns the SM2 domain parameters in explicit form, as
+// openssl ec -param_enc explicit writes them.
+func sm2ECParameters() ecParameters {
+	params := P256Sm2().Params()
+	return ecParameters{
+		Version: 1,
+		FieldID: ecFieldID{FieldType: oidPrimeField, Prime: params.P},
+		Curve: ecCurve{
+			A: bigIntTo32Bytes(new(big.Int).Sub(params.P, big.NewInt(3))),
+			B: bigIntTo32Bytes(params.B),
+		},
+		Base:     elliptic.Marshal(P256Sm2(), params.Gx, params.Gy),
+		Order:    params.N,
+		Cofactor: 1,
+	}
+}
+
+// sm2CurveFromParameters returns the SM2 curve for the ECParameters der
+// of a key: the named curve OID of SM2, explicit parameters equal to those
+// of P256Sm2(), or nothing, which has always been read as SM2.
+func sm2CurveFromParameters(der []byte) (elliptic.Curve, error) {
+	if len(der) == 0 {
+		return P256Sm2(), nil
+	}
+	var namedCurveOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(der, &namedCurveOID); err == nil {
+		curve := namedCurveFromOID(namedCurveOID)
+		if !isSM2Curve(curve) {
+			return nil, UnsupportedAlgorithmError{"named curve", namedCurveOID}
+		}
+		return curve, nil
+	}
+	var params ecParameters
+	if rest, err := asn1.Unmarshal(der, &params); err != nil || len(rest) != 0 {
+		return nil, errors.New("x509: invalid elliptic curve parameters")
+	}
+	want := sm2ECParameters()
+	if params.Version != want.Version ||
+		!params.FieldID.FieldType.Equal(oidPrimeField) ||
+		params.FieldID.Prime == nil || params.FieldID.Prime.Cmp(want.FieldID.Prime) != 0 ||
+		new(big.Int).SetBytes(params.Curve.A).Cmp(new(big.Int).SetBytes(want.Curve.A)) != 0 ||
+		new(big.Int).SetBytes(params.Curve.B).Cmp(new(big.Int).SetBytes(want.Curve.B)) != 0 ||
+		!bytes.Equal(params.Base, want.Base) ||
+		params.Order == nil || params.Order.Cmp(want.Order) != 0 ||
+		(params.Cofactor != 0 && params.Cofactor != want.Cofactor) {
+		return nil, errors.New("x509: explicit elliptic curve parameters are not those of SM2")
+	}
+	return P256Sm2(), nil
+}
+
+// ecPrivateKey is sm2PrivateKey for parsing, with the parameters, a named
+// curve OID or explicit ecParameters, left as the DER in Parameters.Bytes.
+type ecPrivateKey struct {
+	Version    int
+	PrivateKey []byte
+	Parameters asn1.RawValue  `asn1:"optional,explicit,tag:0"`
+	PublicKey  asn1.BitString `asn1:"optional,explicit,tag:1"`
+}
+
+// sm2ExplicitPrivateKey is sm2PrivateKey with explicit domain parameters.
+type sm2ExplicitPrivateKey struct {
+	Version    int
+	PrivateKey []byte
+	Parameters ecParameters   `asn1:"explicit,tag:0"`
+	PublicKey  asn1.BitString `asn1:"optional,explicit,tag:1"`
+}
+
+// MarshalSm2ExplicitPrivateKey returns key as an unencrypted SEC 1
+// ECPrivateKey, without the PKCS#8 wrapper, carrying the SM2 domain
+// parameters themselves instead of the OID 1.2.156.10197.1.301 for peers
+// that do not recognize it.
+func MarshalSm2ExplicitPrivateKey(key *PrivateKey) ([]byte, error) {
+	if nilPrivateKey(key) {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(key.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
+	return asn1.Marshal(sm2ExplicitPrivateKey{
+		Version:    ecPrivKeyVersion,
+		PrivateKey: bigIntTo32Bytes(key.D),
+		Parameters: sm2ECParameters(),
+		PublicKey:  asn1.BitString{Bytes: elliptic.Marshal(key.Curve, key.X, key.Y)},
+	})
+}
+
+// WritePrivateKeytoMemExplicit returns MarshalSm2ExplicitPrivateKey of key
+// as an "EC PRIVATE KEY" PEM block.
+func WritePrivateKeytoMemExplicit(key *PrivateKey) ([]byte, error) {
+	der, err := MarshalSm2ExplicitPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// MarshalPKCS8PrivateKey is x509.MarshalPKCS8PrivateKey extended with SM2:
+// a *PrivateKey is encoded as by MarshalSm2UnecryptedPrivateKey and other
+// keys are passed to crypto/x509, so code holding keys of several types as
+// crypto.PrivateKey can marshal them all with one call.
+func MarshalPKCS8PrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	if priv, ok := key.(*PrivateKey); ok {
+		return MarshalSm2UnecryptedPrivateKey(priv)
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// ParsePKCS8Key is the counterpart of MarshalPKCS8PrivateKey. It returns a
+// *PrivateKey for an unencrypted PKCS#8 key on the SM2 curve and otherwise
+// the result of x509.ParsePKCS8PrivateKey.
+func ParsePKCS8Key(der []byte) (crypto.PrivateKey, error) {
+	var privKey pkcs8
+	if _, err := asn1.Unmarshal(der, &privKey); err == nil && privKey.Algo.Algorithm.Equal(oidSM2) &&
+		len(privKey.Algo.Parameters.FullBytes) != 0 {
+		if _, err := sm2CurveFromParameters(privKey.Algo.Parameters.FullBytes); err == nil {
+			return ParsePKCS8UnecryptedPrivateKey(der)
+		}
+	}
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+// PublicKeyFormats returns the public key of priv as the 65-byte
+// uncompressed point, the 33-byte SEC1 compressed point and the
+// SubjectPublicKeyInfo DER.
+func (priv *PrivateKey) PublicKeyFormats() (uncompressed, compressed, spkiDER []byte, err error) {
+	if nilPrivateKey(priv) {
+		return nil, nil, nil, ErrNilKey
+	}
+	pub := &priv.PublicKey
+	spkiDER, err = MarshalSm2PublicKey(pub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	uncompressed = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	compressed = append([]byte{2 + byte(pub.Y.Bit(0))}, bigIntTo32Bytes(pub.X)...)
+	return uncompressed, compressed, spkiDER, nil
+}
+
+// CanonicalDER returns the unencrypted PKCS#8 DER encoding of priv. The
+// encoding is deterministic: the private key is always 32 bytes, the named
+// curve and the uncompressed public key are always present, so equal keys
+// produce identical bytes whatever encoding they were read from.
+func (priv *PrivateKey) CanonicalDER() ([]byte, error) {
+	return MarshalSm2UnecryptedPrivateKey(priv)
+}
+
 func MarshalSm2EcryptedPrivateKey(PrivKey *PrivateKey, pwd []byte) ([]byte, error) {
+	return MarshalSm2EcryptedPrivateKeyWithOptions(PrivKey, pwd, nil)
+}
+
+// MarshalSm2EcryptedPrivateKeyWithOptions is like
+// MarshalSm2EcryptedPrivateKey but encrypts with the cipher from opts.
+func MarshalSm2EcryptedPrivateKeyWithOptions(PrivKey *PrivateKey, pwd []byte, opts *EncryptOptions) ([]byte, error) {
 	der, err := MarshalSm2UnecryptedPrivateKey(PrivKey)
 	if err != nil {
 		return nil, err
 	}
-	iter := 2048
-	salt := make([]byte, 8)
+	iter := iterationCount
+	saltLen, err := opts.saltLen()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltLen)
 	iv := make([]byte, 16)
-	rand.Reader.Read(salt)
-	rand.Reader.Read(iv)
+	if _, err := io.ReadFull(opts.rand(), salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(opts.rand(), iv); err != nil {
+		return nil, err
+	}
 	key := pbkdf(pwd, salt, iter, 32, sha1.New) // 默认是SHA1
 	padding := aes.BlockSize - len(der)%aes.BlockSize
 	if padding > 0 {
@@ -323,7 +787,7 @@ func MarshalSm2EcryptedPrivateKey(PrivKey *PrivateKey, pwd []byte) ([]byte, erro
 		}
 	}
 	encryptedKey := make([]byte, len(der))
-	block, err := aes.NewCipher(key)
+	block, err := opts.newCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -367,17 +831,45 @@ func MarshalSm2PrivateKey(key *PrivateKey, pwd []byte) ([]byte, error) {
 	return MarshalSm2EcryptedPrivateKey(key, pwd)
 }
 
+// ReadPrivateKeyFromMem parses a PKCS#8 private key, encrypted with pwd or
+// not, given as a PEM block, as bare base64 or as binary DER.
 func ReadPrivateKeyFromMem(data []byte, pwd []byte) (*PrivateKey, error) {
 	var block *pem.Block
 
 	block, _ = pem.Decode(data)
 	if block == nil {
-		return nil, errors.New("failed to decode private key")
+		if len(data) > 0 && data[0] == 0x30 { // DER SEQUENCE
+			return ParsePKCS8PrivateKey(data, pwd)
+		}
+		der, err := decodeBase64DER(data)
+		if err != nil {
+			return nil, errors.New("failed to decode private key")
+		}
+		return ParsePKCS8PrivateKey(der, pwd)
 	}
 	priv, err := ParsePKCS8PrivateKey(block.Bytes, pwd)
 	return priv, err
 }
 
+// IsEncryptedPEM reports whether the PEM private key in data is encrypted,
+// so callers can ask for a password only when one is needed. The key is
+// not decrypted: a block is encrypted if its type is ENCRYPTED PRIVATE KEY
+// or its DER is a PBES2 EncryptedPrivateKeyInfo.
+func IsEncryptedPEM(data []byte) (bool, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, errors.New("x509: failed to decode PEM block")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return true, nil
+	}
+	var keyInfo EncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &keyInfo); err != nil {
+		return false, nil
+	}
+	return keyInfo.EncryptionAlgorithm.IdPBES2.Equal(oidPBES2), nil
+}
+
 func ReadPrivateKeyFromPem(FileName string, pwd []byte) (*PrivateKey, error) {
 	data, err := ioutil.ReadFile(FileName)
 	if err != nil {
@@ -386,60 +878,109 @@ func ReadPrivateKeyFromPem(FileName string, pwd []byte) (*PrivateKey, error) {
 	return ReadPrivateKeyFromMem(data, pwd)
 }
 
-func WritePrivateKeytoMem(key *PrivateKey, pwd []byte) ([]byte, error) {
-	var block *pem.Block
+// CheckKeyFilePermissions returns an error if path is not a regular file
+// or, on Unix, if it is readable or writable by group or others
+// (mode & 0077 != 0), the usual sign of a private key deployed with the
+// wrong mode.
+func CheckKeyFilePermissions(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("SM2: " + path + " is not a regular file")
+	}
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return nil
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("SM2: private key file %s is accessible by group or others (mode %#o)", path, perm)
+	}
+	return nil
+}
 
+func privateKeyPEMBlock(key *PrivateKey, pwd []byte) (*pem.Block, error) {
 	der, err := MarshalSm2PrivateKey(key, pwd)
 	if err != nil {
 		return nil, err
 	}
 	if pwd != nil {
-		block = &pem.Block{
+		return &pem.Block{
 			Type:  "ENCRYPTED PRIVATE KEY",
 			Bytes: der,
-		}
-	} else {
-		block = &pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: der,
-		}
+		}, nil
 	}
-	return pem.EncodeToMemory(block), nil
+	return &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}, nil
 }
 
-func WritePrivateKeytoPem(FileName string, key *PrivateKey, pwd []byte) (bool, error) {
-	var block *pem.Block
-
-	der, err := MarshalSm2PrivateKey(key, pwd)
+func WritePrivateKeytoMem(key *PrivateKey, pwd []byte) ([]byte, error) {
+	block, err := privateKeyPEMBlock(key, pwd)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if pwd != nil {
-		block = &pem.Block{
-			Type:  "ENCRYPTED PRIVATE KEY",
-			Bytes: der,
-		}
-	} else {
-		block = &pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: der,
-		}
+	return pem.EncodeToMemory(block), nil
+}
+
+// WritePrivateKeyTo writes key to w as a PEM encoded PKCS#8 private key,
+// encrypted with pwd unless pwd is nil.
+func WritePrivateKeyTo(w io.Writer, key *PrivateKey, pwd []byte) error {
+	block, err := privateKeyPEMBlock(key, pwd)
+	if err != nil {
+		return err
 	}
-	file, err := os.Create(FileName)
+	return pem.Encode(w, block)
+}
+
+func WritePrivateKeytoPem(FileName string, key *PrivateKey, pwd []byte) (bool, error) {
+	block, err := privateKeyPEMBlock(key, pwd)
 	if err != nil {
 		return false, err
 	}
-	defer file.Close()
-	err = pem.Encode(file, block)
-	if err != nil {
+	if err := writePEMFile(FileName, block); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// writePEMFile creates name and writes block to it.
+func writePEMFile(name string, block *pem.Block) error {
+	return writeFile(name, func(w io.Writer) error {
+		return pem.Encode(w, block)
+	})
+}
+
+// writeFile creates name and calls write on it.
+func writeFile(name string, write func(io.Writer) error) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	return writeAndClose(file, write)
+}
+
+// writeAndClose calls write on wc and closes it. Close's error is returned
+// too, as a failed final flush means the file is incomplete.
+func writeAndClose(wc io.WriteCloser, write func(io.Writer) error) error {
+	if err := write(wc); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
 func ReadPublicKeyFromMem(data []byte, _ []byte) (*PublicKey, error) {
 	block, _ := pem.Decode(data)
-	if block == nil || block.Type != "PUBLIC KEY" {
+	if block == nil {
+		der, err := decodeBase64DER(data)
+		if err != nil {
+			return nil, errors.New("failed to decode public key")
+		}
+		return ParseSm2PublicKey(der)
+	}
+	if !isPEMType(block, publicKeyPEMTypes) {
 		return nil, errors.New("failed to decode public key")
 	}
 	pub, err := ParseSm2PublicKey(block.Bytes)
@@ -454,6 +995,25 @@ func ReadPublicKeyFromPem(FileName string, pwd []byte) (*PublicKey, error) {
 	return ReadPublicKeyFromMem(data, pwd)
 }
 
+// ReadKeyPairFromPem reads a private key from privFile and its public key
+// from pubFile, and returns an error unless the public key is [D]G.
+func ReadKeyPairFromPem(privFile, pubFile string, pwd []byte) (*PrivateKey, error) {
+	priv, err := ReadPrivateKeyFromPem(privFile, pwd)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ReadPublicKeyFromPem(pubFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	x, y := priv.Curve.ScalarBaseMult(priv.D.Bytes())
+	if !isSM2Curve(pub.Curve) || x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+		return nil, errors.New("SM2: " + pubFile + " does not hold the public key of " + privFile)
+	}
+	priv.X, priv.Y = x, y
+	return priv, nil
+}
+
 func WritePublicKeytoMem(key *PublicKey, _ []byte) ([]byte, error) {
 	der, err := MarshalSm2PublicKey(key)
 	if err != nil {
@@ -466,23 +1026,157 @@ func WritePublicKeytoMem(key *PublicKey, _ []byte) ([]byte, error) {
 	return pem.EncodeToMemory(block), nil
 }
 
-func WritePublicKeytoPem(FileName string, key *PublicKey, _ []byte) (bool, error) {
+// WritePublicKeyTo writes key to w as a PEM encoded SubjectPublicKeyInfo.
+func WritePublicKeyTo(w io.Writer, key *PublicKey) error {
 	der, err := MarshalSm2PublicKey(key)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(w, &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	})
+}
+
+func WritePublicKeytoPem(FileName string, key *PublicKey, _ []byte) (bool, error) {
+	if _, err := MarshalSm2PublicKey(key); err != nil {
+		return false, err
+	}
+	err := writeFile(FileName, func(w io.Writer) error {
+		return WritePublicKeyTo(w, key)
+	})
 	if err != nil {
 		return false, err
 	}
+	return true, nil
+}
+
+// WritePublicKeytoMemCompressed is like WritePublicKeytoMem but writes the
+// point compressed, see MarshalSm2PublicKeyCompressed.
+func WritePublicKeytoMemCompressed(key *PublicKey) ([]byte, error) {
+	der, err := MarshalSm2PublicKeyCompressed(key)
+	if err != nil {
+		return nil, err
+	}
 	block := &pem.Block{
 		Type:  "PUBLIC KEY",
 		Bytes: der,
 	}
-	file, err := os.Create(FileName)
-	defer file.Close()
+	return pem.EncodeToMemory(block), nil
+}
+
+// WritePublicKeytoPemCompressed is like WritePublicKeytoPem but writes the
+// point compressed, see MarshalSm2PublicKeyCompressed.
+func WritePublicKeytoPemCompressed(FileName string, key *PublicKey) (bool, error) {
+	der, err := MarshalSm2PublicKeyCompressed(key)
 	if err != nil {
 		return false, err
 	}
-	err = pem.Encode(file, block)
-	if err != nil {
+	block := &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}
+	if err := writePEMFile(FileName, block); err != nil {
 		return false, err
 	}
 	return true, nil
 }
+
+// PEM block types of certificates, of private keys and, as some GM tools
+// label the SubjectPublicKeyInfo differently, of public keys.
+var (
+	certificatePEMTypes = []string{"CERTIFICATE"}
+	privateKeyPEMTypes  = []string{"PRIVATE KEY", "ENCRYPTED PRIVATE KEY"}
+	publicKeyPEMTypes   = []string{"PUBLIC KEY", "SM2 PUBLIC KEY", "EC PUBLIC KEY"}
+)
+
+func isPEMType(block *pem.Block, types []string) bool {
+	for _, t := range types {
+		if block.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// pemBlocks returns the PEM blocks in data of one of types, in order.
+// Blocks of other types are skipped.
+func pemBlocks(data []byte, types []string) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		if isPEMType(block, types) {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+// findPEMBlock returns the first PEM block in data of one of types, or nil.
+func findPEMBlock(data []byte, types []string) *pem.Block {
+	if blocks := pemBlocks(data, types); len(blocks) != 0 {
+		return blocks[0]
+	}
+	return nil
+}
+
+// ReadPrivateKeyFromPEMBundle is like ReadPrivateKeyFromMem but data may hold
+// several PEM blocks, such as a key followed by its certificate. The first
+// PRIVATE KEY or ENCRYPTED PRIVATE KEY block is used.
+func ReadPrivateKeyFromPEMBundle(data, pwd []byte) (*PrivateKey, error) {
+	block := findPEMBlock(data, privateKeyPEMTypes)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
+	}
+	return ParsePKCS8PrivateKey(block.Bytes, pwd)
+}
+
+// ReadPublicKeyFromPEMBundle is like ReadPublicKeyFromMem but data may hold
+// several PEM blocks. The first public key block is used.
+func ReadPublicKeyFromPEMBundle(data []byte) (*PublicKey, error) {
+	block := findPEMBlock(data, publicKeyPEMTypes)
+	if block == nil {
+		return nil, errors.New("failed to decode public key")
+	}
+	return ParseSm2PublicKey(block.Bytes)
+}
+
+// WritePublicKeyToDER returns the DER SubjectPublicKeyInfo of key, the
+// content of the PEM block written by WritePublicKeytoMem.
+func WritePublicKeyToDER(key *PublicKey) ([]byte, error) {
+	return MarshalSm2PublicKey(key)
+}
+
+// ReadPublicKeyFromDER parses a DER SubjectPublicKeyInfo as written by
+// WritePublicKeyToDER. Data following the SubjectPublicKeyInfo is an error.
+func ReadPublicKeyFromDER(der []byte) (*PublicKey, error) {
+	var raw asn1.RawValue
+	rest, err := asn1.Unmarshal(der, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("x509: trailing data after public key")
+	}
+	return ParseSm2PublicKey(der)
+}
+
+// decodeBase64DER decodes DER given as bare base64 without the PEM armour,
+// as it is often copied from a UI. Whitespace anywhere in the input is
+// ignored, other characters outside the base64 alphabet are rejected.
+func decodeBase64DER(data []byte) ([]byte, error) {
+	b64 := bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+			return -1
+		}
+		return r
+	}, data)
+	if len(b64) == 0 {
+		return nil, errors.New("x509: no key data")
+	}
+	return base64.StdEncoding.DecodeString(string(b64))
+}
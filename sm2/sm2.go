@@ -18,17 +18,22 @@ package sm2
 // reference to ecdsa
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/asn1"
-	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
 	"math/big"
+	"runtime"
+	"sync"
 
 	"github.com/tjfoc/gmsm/sm3"
 )
@@ -51,11 +56,129 @@ type sm2Signature struct {
 	R, S *big.Int
 }
 
+// ErrNilKey is returned when a nil key, or a key missing its curve or
+// coordinates, is passed to an operation that needs it.
+var ErrNilKey = errors.New("SM2: nil key")
+
+func nilPublicKey(pub *PublicKey) bool {
+	return pub == nil || pub.Curve == nil || pub.X == nil || pub.Y == nil
+}
+
+// ErrUnsupportedCurve is returned when a key's curve is not a recognized
+// SM2 curve.
+var ErrUnsupportedCurve = errors.New("SM2: unsupported curve")
+
+// isSM2Curve reports whether c has the domain parameters of the curve
+// recommended by GB/T 32918.5, currently the only standardized SM2 curve.
+func isSM2Curve(c elliptic.Curve) bool {
+	if c == nil {
+		return false
+	}
+	params, sm2 := c.Params(), P256Sm2().Params()
+	return params != nil && params.P != nil && params.N != nil &&
+		params.B != nil && params.Gx != nil && params.Gy != nil &&
+		params.P.Cmp(sm2.P) == 0 && params.N.Cmp(sm2.N) == 0 &&
+		params.B.Cmp(sm2.B) == 0 && params.Gx.Cmp(sm2.Gx) == 0 &&
+		params.Gy.Cmp(sm2.Gy) == 0
+}
+
+// ValidatePublicKey checks that pub is a point of the SM2 curve other than
+// the point at infinity. The cofactor of the curve is 1, so every other
+// point of it has order n and there are no small order points to reject.
+func ValidatePublicKey(pub *PublicKey) error {
+	if nilPublicKey(pub) {
+		return ErrNilKey
+	}
+	if !isSM2Curve(pub.Curve) {
+		return ErrUnsupportedCurve
+	}
+	if pub.X.Sign() == 0 && pub.Y.Sign() == 0 {
+		return errors.New("SM2: public key is the point at infinity")
+	}
+	P := pub.Curve.Params().P
+	if pub.X.Sign() < 0 || pub.Y.Sign() < 0 || pub.X.Cmp(P) >= 0 || pub.Y.Cmp(P) >= 0 ||
+		!pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return errors.New("SM2: public key is not on curve")
+	}
+	return nil
+}
+
+func nilPrivateKey(priv *PrivateKey) bool {
+	return priv == nil || priv.D == nil || nilPublicKey(&priv.PublicKey)
+}
+
 // The SM2's private key contains the public key
 func (priv *PrivateKey) Public() crypto.PublicKey {
+	if priv == nil {
+		return nil
+	}
 	return &priv.PublicKey
 }
 
+// Equal reports whether pub and x have the same curve and point, as
+// crypto.PublicKey implementations do since Go 1.15.
+func (pub *PublicKey) Equal(x crypto.PublicKey) bool {
+	xx, ok := x.(*PublicKey)
+	if !ok || nilPublicKey(pub) || nilPublicKey(xx) {
+		return false
+	}
+	return pub.Curve == xx.Curve && pub.X.Cmp(xx.X) == 0 && pub.Y.Cmp(xx.Y) == 0
+}
+
+// ToECDSA returns pub as an *ecdsa.PublicKey with the same curve and
+// point, to pass it through code typed on ecdsa keys. crypto/ecdsa does
+// not implement SM2: ecdsa.Verify and the like on the result are ECDSA over
+// the SM2 curve, not SM2. Convert back with FromECDSA before using it.
+func ToECDSA(pub *PublicKey) *ecdsa.PublicKey {
+	if pub == nil {
+		return nil
+	}
+	return &ecdsa.PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}
+}
+
+// FromECDSA returns the SM2 public key held in pub, as made by ToECDSA.
+// The curve of pub must be the SM2 curve.
+func FromECDSA(pub *ecdsa.PublicKey) (*PublicKey, error) {
+	if pub == nil || pub.Curve == nil || pub.X == nil || pub.Y == nil {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(pub.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
+	return &PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}, nil
+}
+
+// Equal reports whether priv and x are the same key. D is compared in
+// constant time.
+func (priv *PrivateKey) Equal(x crypto.PrivateKey) bool {
+	xx, ok := x.(*PrivateKey)
+	if !ok || nilPrivateKey(priv) || nilPrivateKey(xx) {
+		return false
+	}
+	return priv.PublicKey.Equal(&xx.PublicKey) &&
+		subtle.ConstantTimeCompare(bigIntTo32Bytes(priv.D), bigIntTo32Bytes(xx.D)) == 1
+}
+
+// Recompute sets the public key of priv from D, for keys of which only D was
+// filled in. A nil curve is taken to be P256Sm2.
+func (priv *PrivateKey) Recompute() error {
+	if priv == nil || priv.D == nil {
+		return ErrNilKey
+	}
+	if priv.Curve == nil {
+		priv.Curve = P256Sm2()
+	}
+	if !isSM2Curve(priv.Curve) {
+		return ErrUnsupportedCurve
+	}
+	// d is in [1, n-2]
+	if priv.D.Sign() <= 0 || priv.D.Cmp(new(big.Int).Sub(priv.Curve.Params().N, one)) >= 0 {
+		return errors.New("SM2: invalid private key")
+	}
+	priv.X, priv.Y = priv.Curve.ScalarBaseMult(priv.D.Bytes())
+	return nil
+}
+
 func SignDigitToSignData(r, s *big.Int) ([]byte, error) {
 	return asn1.Marshal(sm2Signature{r, s})
 }
@@ -70,9 +193,50 @@ func SignDataToSignDigit(sign []byte) (*big.Int, *big.Int, error) {
 	return sm2Sign.R, sm2Sign.S, nil
 }
 
+// SignerOpts may be passed to PrivateKey.Sign, SignDigestWithOpts,
+// Sm2SignWithOpts, SignWithOpts and NewSigner.
+type SignerOpts struct {
+	// VerifyAfterSign verifies each signature before returning it. A
+	// fault injected while signing can yield a signature that leaks the
+	// private key; the check turns it into ErrSignatureFault at the cost
+	// of a verification.
+	VerifyAfterSign bool
+}
+
+// HashFunc returns 0: the message passed to PrivateKey.Sign is already the
+// SM2 digest e.
+func (*SignerOpts) HashFunc() crypto.Hash { return 0 }
+
+// ErrSignatureFault is returned when a signature made with
+// SignerOpts.VerifyAfterSign does not verify.
+var ErrSignatureFault = errors.New("SM2: signature failed verification after signing")
+
+// NewSigner returns a crypto.Signer for priv whose Sign uses opts in place
+// of the options it is called with. Passed to CreateCertificate, CreateCRL
+// or CreateCertificateRequest, it makes them sign with opts.
+func NewSigner(priv *PrivateKey, opts *SignerOpts) crypto.Signer {
+	return &optsSigner{priv, opts}
+}
+
+type optsSigner struct {
+	priv *PrivateKey
+	opts *SignerOpts
+}
+
+func (s *optsSigner) Public() crypto.PublicKey {
+	return s.priv.Public()
+}
+
+func (s *optsSigner) Sign(rand io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return s.priv.Sign(rand, digest, s.opts)
+}
+
 // sign format = 30 + len(z) + 02 + len(r) + r + 02 + len(s) + s, z being what follows its size, ie 02+len(r)+r+02+len(s)+s
+// As required by crypto.Signer, msg is the digest e, see SignDigest. opts
+// may be a *SignerOpts.
 func (priv *PrivateKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
-	r, s, err := Sign(priv, msg)
+	o, _ := opts.(*SignerOpts)
+	r, s, err := SignDigestWithOpts(priv, msg, rand, o)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +247,8 @@ func (priv *PrivateKey) Decrypt(data []byte) ([]byte, error) {
 	return Decrypt(priv, data)
 }
 
+// Verify verifies an ASN.1 signature of the digest msg made by
+// PrivateKey.Sign, see VerifyDigest.
 func (pub *PublicKey) Verify(msg []byte, sign []byte) bool {
 	var sm2Sign sm2Signature
 
@@ -90,7 +256,7 @@ func (pub *PublicKey) Verify(msg []byte, sign []byte) bool {
 	if err != nil {
 		return false
 	}
-	return Verify(pub, msg, sm2Sign.R, sm2Sign.S)
+	return VerifyDigest(pub, msg, sm2Sign.R, sm2Sign.S)
 }
 
 func (pub *PublicKey) Encrypt(data []byte) ([]byte, error) {
@@ -99,37 +265,9 @@ func (pub *PublicKey) Encrypt(data []byte) ([]byte, error) {
 
 var one = new(big.Int).SetInt64(1)
 
-func intToBytes(x int) []byte {
-	var buf = make([]byte, 4)
-
-	binary.BigEndian.PutUint32(buf, uint32(x))
-	return buf
-}
-
-func kdf(x, y []byte, length int) ([]byte, bool) {
-	var c []byte
-
-	ct := 1
-	h := sm3.New()
-	x = append(x, y...)
-	for i, j := 0, (length+31)/32; i < j; i++ {
-		h.Reset()
-		h.Write(x)
-		h.Write(intToBytes(ct))
-		hash := h.Sum(nil)
-		if i+1 == j && length%32 != 0 {
-			c = append(c, hash[:length%32]...)
-		} else {
-			c = append(c, hash...)
-		}
-		ct++
-	}
-	for i := 0; i < length; i++ {
-		if c[i] != 0 {
-			return c, true
-		}
-	}
-	return c, false
+func kdf(length int, x ...[]byte) ([]byte, bool) {
+	c := sm3.KDF(bytes.Join(x, nil), length)
+	return c, c != nil
 }
 
 func randFieldElement(c elliptic.Curve, rand io.Reader) (k *big.Int, err error) {
@@ -147,8 +285,17 @@ func randFieldElement(c elliptic.Curve, rand io.Reader) (k *big.Int, err error)
 }
 
 func GenerateKey() (*PrivateKey, error) {
+	return GenerateKeyWithReader(rand.Reader)
+}
+
+// GenerateKeyWithReader generates a key pair on the SM2 curve reading
+// randomness from random. crypto/rand.Reader is used when random is nil.
+func GenerateKeyWithReader(random io.Reader) (*PrivateKey, error) {
+	if random == nil {
+		random = rand.Reader
+	}
 	c := P256Sm2()
-	k, err := randFieldElement(c, rand.Reader)
+	k, err := randFieldElement(c, random)
 	if err != nil {
 		return nil, err
 	}
@@ -159,15 +306,154 @@ func GenerateKey() (*PrivateKey, error) {
 	return priv, nil
 }
 
+// lockedReader serializes reads from an io.Reader that is shared by
+// several goroutines.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
+// GenerateKeys generates n keys as GenerateKey does, spread over a pool of
+// runtime.NumCPU() goroutines that share random under a lock. Every key is
+// checked with ValidatePublicKey. If ctx is canceled before all keys are
+// generated, GenerateKeys stops and returns ctx.Err().
+func GenerateKeys(ctx context.Context, n int, random io.Reader) ([]*PrivateKey, error) {
+	if n < 0 {
+		return nil, errors.New("SM2: negative key count")
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &lockedReader{r: random}
+
+	keys := make([]*PrivateKey, n)
+	jobs := make(chan int)
+	errc := make(chan error, 1)
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				priv, err := GenerateKeyWithReader(r)
+				if err == nil {
+					err = ValidatePublicKey(&priv.PublicKey)
+				}
+				if err != nil {
+					select {
+					case errc <- err:
+					default:
+					}
+					cancel()
+					return
+				}
+				keys[i] = priv
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errc:
+		return nil, err
+	default:
+	}
+	for _, priv := range keys {
+		if priv == nil {
+			return nil, ctx.Err()
+		}
+	}
+	return keys, nil
+}
+
 var errZeroParam = errors.New("zero parameter")
 
-func Sign(priv *PrivateKey, hash []byte) (r, s *big.Int, err error) {
+// Sign signs msg with the default user ID, computing e = SM3(ZA || msg)
+// first.
+func Sign(priv *PrivateKey, msg []byte) (r, s *big.Int, err error) {
+	return SignWithReader(priv, msg, rand.Reader)
+}
+
+// SignWithReader is like Sign but derives the nonce as SignDigest does,
+// with randomness read from random.
+func SignWithReader(priv *PrivateKey, msg []byte, random io.Reader) (r, s *big.Int, err error) {
+	if nilPrivateKey(priv) {
+		return nil, nil, ErrNilKey
+	}
+	za, err := ZA(&priv.PublicKey, defaultUid)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := msgHash(za, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return SignDigest(priv, bigIntTo32Bytes(e), random)
+}
+
+// SignDigest signs the digest hash, which must already be e = SM3(ZA || M),
+// mixing the private key and the hash with randomness read from random to
+// derive the nonce. crypto/rand.Reader is used when random is nil.
+func SignDigest(priv *PrivateKey, hash []byte, random io.Reader) (r, s *big.Int, err error) {
+	return SignDigestWithOpts(priv, hash, random, nil)
+}
+
+// SignDigestWithOpts is like SignDigest but signs as opts asks, see
+// SignerOpts. opts may be nil. Sign, Sm2Sign and their variants sign
+// through it.
+func SignDigestWithOpts(priv *PrivateKey, hash []byte, random io.Reader, opts *SignerOpts) (r, s *big.Int, err error) {
+	if nilPrivateKey(priv) {
+		return nil, nil, ErrNilKey
+	}
+	if !isSM2Curve(priv.Curve) {
+		return nil, nil, ErrUnsupportedCurve
+	}
+	r, s, err = signHedged(priv, hash, random)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts != nil && opts.VerifyAfterSign && !VerifyDigest(&priv.PublicKey, hash, r, s) {
+		return nil, nil, ErrSignatureFault
+	}
+	return r, s, nil
+}
+
+// signHedged signs e with a hedged nonce: k is not read from random but
+// from AES-256-CTR keyed with the first 32 bytes of
+// SHA-512(d || entropy || e), where entropy is 16 bytes read from random.
+// k stays secret as long as either d or the entropy is, and entropy that a
+// broken random repeats does not repeat k for another message. With a
+// working random two signatures of the same message differ.
+func signHedged(priv *PrivateKey, hash []byte, random io.Reader) (r, s *big.Int, err error) {
 	entropylen := (priv.Curve.Params().BitSize + 7) / 16
 	if entropylen > 32 {
 		entropylen = 32
 	}
 	entropy := make([]byte, entropylen)
-	_, err = io.ReadFull(rand.Reader, entropy)
+	if random == nil {
+		random = rand.Reader
+	}
+	_, err = io.ReadFull(random, entropy)
 	if err != nil {
 		return
 	}
@@ -199,39 +485,70 @@ func Sign(priv *PrivateKey, hash []byte) (r, s *big.Int, err error) {
 	if N.Sign() == 0 {
 		return nil, nil, errZeroParam
 	}
-	var k *big.Int
 	e := new(big.Int).SetBytes(hash)
-	for { // 调整算法细节以实现SM2
-		for {
-			k, err = randFieldElement(c, csprng)
-			if err != nil {
-				r = nil
-				return
-			}
-			r, _ = priv.Curve.ScalarBaseMult(k.Bytes())
-			r.Add(r, e)
-			r.Mod(r, N)
-			if r.Sign() != 0 {
-				break
-			}
-			if t := new(big.Int).Add(r, k); t.Cmp(N) == 0 {
-				break
-			}
+	for {
+		k, err := randFieldElement(c, csprng)
+		if err != nil {
+			return nil, nil, err
 		}
-		rD := new(big.Int).Mul(priv.D, r)
-		s = new(big.Int).Sub(k, rD)
-		d1 := new(big.Int).Add(priv.D, one)
-		d1Inv := new(big.Int).ModInverse(d1, N)
-		s.Mul(s, d1Inv)
-		s.Mod(s, N)
-		if s.Sign() != 0 {
-			break
+		if r, s = signWithK(priv, e, k); r != nil {
+			return r, s, nil
 		}
 	}
-	return
 }
 
-func Verify(pub *PublicKey, hash []byte, r, s *big.Int) bool {
+// signWithK computes the signature of e with the nonce k, following
+// GB/T 32918.2 section 6.1. It returns nil when k is unusable, that is when
+// r = 0, r + k = n or s = 0, and the caller must pick another k. It is kept
+// separate so tests can reproduce signatures made with a known k.
+func signWithK(priv *PrivateKey, e, k *big.Int) (r, s *big.Int) {
+	N := priv.Curve.Params().N
+	r, _ = priv.Curve.ScalarBaseMult(k.Bytes())
+	r.Add(r, e)
+	r.Mod(r, N)
+	if r.Sign() == 0 || new(big.Int).Add(r, k).Cmp(N) == 0 {
+		return nil, nil
+	}
+	// s = (1 + d)^-1 * (k - r * d) mod n
+	rD := new(big.Int).Mul(priv.D, r)
+	s = new(big.Int).Sub(k, rD)
+	d1 := new(big.Int).Add(priv.D, one)
+	d1Inv := new(big.Int).ModInverse(d1, N)
+	s.Mul(s, d1Inv)
+	s.Mod(s, N)
+	if s.Sign() == 0 {
+		return nil, nil
+	}
+	return r, s
+}
+
+// Verify verifies the signature r, s of msg made with the default user ID.
+func Verify(pub *PublicKey, msg []byte, r, s *big.Int) bool {
+	if ValidatePublicKey(pub) != nil {
+		return false
+	}
+	za, err := ZA(pub, defaultUid)
+	if err != nil {
+		return false
+	}
+	e, err := msgHash(za, msg)
+	if err != nil {
+		return false
+	}
+	return VerifyDigest(pub, bigIntTo32Bytes(e), r, s)
+}
+
+// VerifyDigest verifies the signature r, s of the digest hash, which must
+// already be e = SM3(ZA || M).
+func VerifyDigest(pub *PublicKey, hash []byte, r, s *big.Int) bool {
+	if r == nil || s == nil || ValidatePublicKey(pub) != nil {
+		return false
+	}
+	return verifyDigest(pub, hash, r, s)
+}
+
+// verifyDigest is VerifyDigest for a validated pub and non-nil r and s.
+func verifyDigest(pub *PublicKey, hash []byte, r, s *big.Int) bool {
 	c := pub.Curve
 	N := c.Params().N
 
@@ -260,52 +577,250 @@ func Verify(pub *PublicKey, hash []byte, r, s *big.Int) bool {
 	return x.Cmp(r) == 0
 }
 
-func Sm2Sign(priv *PrivateKey, msg, uid []byte) (r, s *big.Int, err error) {
-	za, err := ZA(&priv.PublicKey, uid)
+// VerifierOpts configures NewVerifier.
+type VerifierOpts struct {
+	// SkipValidation skips the ValidatePublicKey check of the key, for
+	// callers that validated it already, for example when loading it.
+	SkipValidation bool
+}
+
+// Verifier verifies signatures by one public key for hot verification
+// paths. The key is checked and converted once, and the temporaries are
+// reused, so that VerifyDigest does not allocate for 32-byte digests. It
+// takes about as long per signature as the function VerifyDigest, or
+// slightly longer: what it saves is garbage collector load, not time. A
+// Verifier must not be used by several goroutines at once.
+type Verifier struct {
+	pub          *PublicKey
+	fast         bool // pub.Curve is P256Sm2
+	x, y         sm2P256FieldElement
+	tmp          sm2P256Scratch
+	t, e, c, res big.Int
+}
+
+// NewVerifier returns a Verifier for pub. Unless opts.SkipValidation is
+// set, pub is checked with ValidatePublicKey.
+func NewVerifier(pub *PublicKey, opts *VerifierOpts) (*Verifier, error) {
+	if nilPublicKey(pub) {
+		return nil, ErrNilKey
+	}
+	if opts == nil || !opts.SkipValidation {
+		if err := ValidatePublicKey(pub); err != nil {
+			return nil, err
+		}
+	}
+	v := &Verifier{pub: pub}
+	if _, ok := pub.Curve.(sm2P256Curve); ok {
+		v.fast = true
+		sm2P256FromBig(&v.x, pub.X)
+		sm2P256FromBig(&v.y, pub.Y)
+	}
+	return v, nil
+}
+
+// VerifyDigest is VerifyDigest with the key of v.
+func (v *Verifier) VerifyDigest(hash []byte, r, s *big.Int) bool {
+	if r == nil || s == nil {
+		return false
+	}
+	if !v.fast || len(hash) > 32 {
+		// below e is reduced with one subtraction, e < 2^256 < 2n
+		return verifyDigest(v.pub, hash, r, s)
+	}
+	N := sm2P256.N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(N) >= 0 || s.Cmp(N) >= 0 {
+		return false
+	}
+	v.t.Add(r, s)
+	if v.t.Cmp(N) >= 0 {
+		v.t.Sub(&v.t, N)
+	}
+	if v.t.Sign() == 0 {
+		return false
+	}
+	// c = (r - e) mod n
+	v.e.SetBytes(hash)
+	if v.e.Cmp(N) >= 0 {
+		v.e.Sub(&v.e, N)
+	}
+	v.c.Sub(r, &v.e)
+	if v.c.Sign() < 0 {
+		v.c.Add(&v.c, N)
+	}
+	valid, done := sm2P256.verifyMult(&v.tmp, &v.x, &v.y, s, &v.t, &v.c, &v.res)
+	if !done {
+		return verifyDigest(v.pub, hash, r, s)
+	}
+	return valid
+}
+
+// SignASN1 signs the digest hash, e = SM3(ZA || M), and returns the ASN.1
+// DER signature. It mirrors ecdsa.SignASN1.
+func SignASN1(rand io.Reader, priv *PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := SignDigest(priv, hash, rand)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	return asn1.Marshal(sm2Signature{r, s})
+}
+
+// VerifyASN1 verifies the ASN.1 DER signature sig of the digest hash. It
+// mirrors ecdsa.VerifyASN1.
+func VerifyASN1(pub *PublicKey, hash, sig []byte) bool {
+	var sm2Sign sm2Signature
+
+	rest, err := asn1.Unmarshal(sig, &sm2Sign)
+	if err != nil || len(rest) != 0 {
+		return false
+	}
+	return VerifyDigest(pub, hash, sm2Sign.R, sm2Sign.S)
+}
+
+// IsCanonical reports whether sig is the one encoding of an SM2 signature
+// this package accepts: a DER SEQUENCE of r and s, 1 <= r, s < n, with no
+// bytes after it.
+//
+// Unlike ECDSA, SM2 has no s / n-s malleability. s = (1+d)^-1 (k - rd) mod n
+// ties s to the private key, and (r, n-s) does not verify, so there is no
+// low-s form to normalize to. The remaining freedom is in the encoding,
+// which IsCanonical, VerifyASN1 and VerifyE pin down: the ASN.1 parser
+// rejects BER lengths and padded integers, and out of range values and
+// trailing data are rejected here.
+func IsCanonical(sig []byte) bool {
+	var sm2Sign sm2Signature
+
+	rest, err := asn1.Unmarshal(sig, &sm2Sign)
+	if err != nil || len(rest) != 0 {
+		return false
+	}
+	N := P256Sm2().Params().N
+	r, s := sm2Sign.R, sm2Sign.S
+	return r.Sign() > 0 && s.Sign() > 0 && r.Cmp(N) < 0 && s.Cmp(N) < 0
+}
+
+// ErrInvalidSignature is returned by VerifyE when a well-formed signature
+// does not verify.
+var ErrInvalidSignature = errors.New("SM2: invalid signature")
+
+// VerifyE verifies the ASN.1 DER signature sig of msg made with the default
+// user ID. Unlike Verify it tells a signature that does not verify,
+// reported as ErrInvalidSignature, from an unusable public key or a
+// signature that cannot be parsed.
+func VerifyE(pub *PublicKey, msg, sig []byte) error {
+	if err := ValidatePublicKey(pub); err != nil {
+		return err
+	}
+	var sm2Sign sm2Signature
+	rest, err := asn1.Unmarshal(sig, &sm2Sign)
+	if err != nil {
+		return errors.New("SM2: malformed signature: " + err.Error())
+	}
+	if len(rest) != 0 {
+		return errors.New("SM2: trailing data after signature")
+	}
+	za, err := ZA(pub, defaultUid)
+	if err != nil {
+		return err
 	}
 	e, err := msgHash(za, msg)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	c := priv.PublicKey.Curve
-	N := c.Params().N
-	if N.Sign() == 0 {
-		return nil, nil, errZeroParam
+	if !VerifyDigest(pub, bigIntTo32Bytes(e), sm2Sign.R, sm2Sign.S) {
+		return ErrInvalidSignature
 	}
-	var k *big.Int
-	for { // 调整算法细节以实现SM2
-		for {
-			k, err = randFieldElement(c, rand.Reader)
-			if err != nil {
-				r = nil
-				return
-			}
-			r, _ = priv.Curve.ScalarBaseMult(k.Bytes())
-			r.Add(r, e)
-			r.Mod(r, N)
-			if r.Sign() != 0 {
+	return nil
+}
+
+// RecoverPublicKeys returns the public keys under which the ASN.1 DER
+// signature sig of the digest hash, e = SM3(ZA || M), verifies. The
+// signature fixes x1 = (r - e) mod n, up to adding n, and each of the at
+// most four points R = (x1, y1) gives P = (r + s)^-1 (R - [s]G), so the
+// verifier must pick the expected key out of the candidates.
+//
+// Recovery needs e itself. As ZA hashes the public key, e cannot be computed
+// from the message and user ID before the key is known, so there is no form
+// of this function taking the message.
+func RecoverPublicKeys(hash, sig []byte) ([]*PublicKey, error) {
+	if !IsCanonical(sig) {
+		return nil, errors.New("SM2: malformed signature")
+	}
+	var sm2Sign sm2Signature
+	if _, err := asn1.Unmarshal(sig, &sm2Sign); err != nil {
+		return nil, err
+	}
+	r, s := sm2Sign.R, sm2Sign.S
+	c := P256Sm2()
+	P, N := c.Params().P, c.Params().N
+	t := new(big.Int).Add(r, s)
+	t.Mod(t, N)
+	if t.Sign() == 0 {
+		return nil, ErrInvalidSignature
+	}
+	tInv := new(big.Int).ModInverse(t, N)
+
+	// -[s]G
+	sx, sy := c.ScalarBaseMult(s.Bytes())
+	sy.Sub(P, sy)
+
+	x1 := new(big.Int).Sub(r, new(big.Int).SetBytes(hash))
+	x1.Mod(x1, N)
+	var keys []*PublicKey
+	for x := x1; x.Cmp(P) < 0; x = new(big.Int).Add(x, N) {
+		for _, prefix := range []byte{2, 3} {
+			R := Decompress(append([]byte{prefix}, bigIntTo32Bytes(x)...))
+			if R == nil {
 				break
 			}
-			if t := new(big.Int).Add(r, k); t.Cmp(N) == 0 {
-				break
+			px, py := c.Add(R.X, R.Y, sx, sy)
+			px, py = c.ScalarMult(px, py, tInv.Bytes())
+			if pub := (&PublicKey{Curve: c, X: px, Y: py}); ValidatePublicKey(pub) == nil {
+				keys = append(keys, pub)
 			}
 		}
-		rD := new(big.Int).Mul(priv.D, r)
-		s = new(big.Int).Sub(k, rD)
-		d1 := new(big.Int).Add(priv.D, one)
-		d1Inv := new(big.Int).ModInverse(d1, N)
-		s.Mul(s, d1Inv)
-		s.Mod(s, N)
-		if s.Sign() != 0 {
-			break
-		}
 	}
-	return
+	if len(keys) == 0 {
+		return nil, ErrInvalidSignature
+	}
+	return keys, nil
+}
+
+// Sm2Sign signs msg with the user ID uid.
+func Sm2Sign(priv *PrivateKey, msg, uid []byte) (r, s *big.Int, err error) {
+	return Sm2SignWithReader(priv, msg, uid, rand.Reader)
+}
+
+// Sm2SignWithReader is like Sm2Sign but derives the nonce from the private
+// key, the message and randomness read from random as for SignDigest.
+// crypto/rand.Reader is used when random is nil.
+func Sm2SignWithReader(priv *PrivateKey, msg, uid []byte, random io.Reader) (r, s *big.Int, err error) {
+	return Sm2SignWithOpts(priv, msg, uid, random, nil)
+}
+
+// Sm2SignWithOpts is like Sm2SignWithReader but signs as opts asks, see
+// SignDigestWithOpts.
+func Sm2SignWithOpts(priv *PrivateKey, msg, uid []byte, random io.Reader, opts *SignerOpts) (r, s *big.Int, err error) {
+	if nilPrivateKey(priv) {
+		return nil, nil, ErrNilKey
+	}
+	if !isSM2Curve(priv.Curve) {
+		return nil, nil, ErrUnsupportedCurve
+	}
+	za, err := ZA(&priv.PublicKey, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := msgHash(za, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return SignDigestWithOpts(priv, bigIntTo32Bytes(e), random, opts)
 }
 
 func Sm2Verify(pub *PublicKey, msg, uid []byte, r, s *big.Int) bool {
+	if r == nil || s == nil || ValidatePublicKey(pub) != nil {
+		return false
+	}
 	c := pub.Curve
 	N := c.Params().N
 	one := new(big.Int).SetInt64(1)
@@ -323,19 +838,215 @@ func Sm2Verify(pub *PublicKey, msg, uid []byte, r, s *big.Int) bool {
 	if err != nil {
 		return false
 	}
+	return verifyDigest(pub, bigIntTo32Bytes(e), r, s)
+}
+
+// SignWithUID signs msg with priv using the user ID uid and returns the
+// ASN.1 DER encoded signature. The default user ID 1234567812345678 is
+// used when uid is nil.
+func SignWithUID(priv *PrivateKey, msg, uid []byte) ([]byte, error) {
+	return SignWithOpts(priv, msg, uid, rand.Reader, nil)
+}
+
+// SignWithOpts is like SignWithUID but reads randomness from random and
+// signs as opts asks, see SignDigestWithOpts. With a nil uid it makes the
+// signature of Sign.
+func SignWithOpts(priv *PrivateKey, msg, uid []byte, random io.Reader, opts *SignerOpts) ([]byte, error) {
+	if uid == nil {
+		uid = defaultUid
+	}
+	r, s, err := Sm2SignWithOpts(priv, msg, uid, random, opts)
+	if err != nil {
+		return nil, err
+	}
+	return SignDigitToSignData(r, s)
+}
+
+// VerifyWithUID verifies the ASN.1 DER encoded signature sig of msg by pub
+// using the user ID uid. The default user ID 1234567812345678 is used when
+// uid is nil.
+func VerifyWithUID(pub *PublicKey, msg, sig, uid []byte) bool {
+	var sm2Sign sm2Signature
+
+	if uid == nil {
+		uid = defaultUid
+	}
+	rest, err := asn1.Unmarshal(sig, &sm2Sign)
+	if err != nil || len(rest) != 0 {
+		return false
+	}
+	return Sm2Verify(pub, msg, uid, sm2Sign.R, sm2Sign.S)
+}
+
+// SignRS is like SignWithUID but returns the signature as the integers r
+// and s, for callers that store them without the ASN.1 encoding.
+func SignRS(priv *PrivateKey, msg, uid []byte) (r, s *big.Int, err error) {
+	if uid == nil {
+		uid = defaultUid
+	}
+	return Sm2Sign(priv, msg, uid)
+}
+
+// VerifyRS is like VerifyWithUID but takes the signature as the integers
+// r and s made by SignRS. It returns false unless both are in [1, n-1].
+func VerifyRS(pub *PublicKey, msg []byte, r, s *big.Int, uid []byte) bool {
+	if uid == nil {
+		uid = defaultUid
+	}
+	return Sm2Verify(pub, msg, uid, r, s)
+}
+
+// VerifyBatch verifies sigs[i], an ASN.1 DER encoded signature of msgs[i]
+// by pubs[i] with the default user ID, and reports the result of each.
+//
+// Each signature is still verified on its own, there is no randomized
+// batch verification. ZA is computed once per distinct *PublicKey and the
+// signatures are spread over a pool of runtime.NumCPU() goroutines.
+func VerifyBatch(pubs []*PublicKey, msgs [][]byte, sigs [][]byte) ([]bool, error) {
+	if len(pubs) != len(msgs) || len(pubs) != len(sigs) {
+		return nil, errors.New("SM2: pubs, msgs and sigs differ in length")
+	}
+	zas := make(map[*PublicKey][]byte)
+	for _, pub := range pubs {
+		if _, ok := zas[pub]; !ok {
+			za, err := ComputeZA(pub, nil)
+			if err != nil {
+				za = nil // every signature by this key fails
+			}
+			zas[pub] = za
+		}
+	}
+
+	res := make([]bool, len(pubs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	if workers > len(pubs) {
+		workers = len(pubs)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				za := zas[pubs[i]]
+				if za == nil {
+					continue
+				}
+				var sm2Sign sm2Signature
+				rest, err := asn1.Unmarshal(sigs[i], &sm2Sign)
+				if err != nil || len(rest) != 0 {
+					continue
+				}
+				e, _ := msgHash(za, msgs[i])
+				res[i] = VerifyDigest(pubs[i], e.Bytes(), sm2Sign.R, sm2Sign.S)
+			}
+		}()
+	}
+	for i := range pubs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return res, nil
+}
+
+// SignToBytes is like SignWithUID but returns the signature in the raw
+// 64-byte r || s form, each half left-padded to 32 bytes.
+func SignToBytes(priv *PrivateKey, msg, uid []byte) ([]byte, error) {
+	if uid == nil {
+		uid = defaultUid
+	}
+	r, s, err := Sm2Sign(priv, msg, uid)
+	if err != nil {
+		return nil, err
+	}
+	return append(bigIntTo32Bytes(r), bigIntTo32Bytes(s)...), nil
+}
+
+// VerifyBytes is like VerifyWithUID but takes the signature in the raw
+// 64-byte r || s form.
+func VerifyBytes(pub *PublicKey, msg, sig, uid []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	if uid == nil {
+		uid = defaultUid
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	return Sm2Verify(pub, msg, uid, r, s)
+}
+
+// SignatureToRS converts an ASN.1 DER encoded signature to the raw 64-byte
+// r || s form.
+func SignatureToRS(der []byte) ([]byte, error) {
+	var sm2Sign sm2Signature
+
+	rest, err := asn1.Unmarshal(der, &sm2Sign)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("SM2: trailing data after signature")
+	}
+	if sm2Sign.R.Sign() <= 0 || sm2Sign.S.Sign() <= 0 ||
+		sm2Sign.R.BitLen() > 256 || sm2Sign.S.BitLen() > 256 {
+		return nil, errors.New("SM2: invalid signature")
+	}
+	return append(bigIntTo32Bytes(sm2Sign.R), bigIntTo32Bytes(sm2Sign.S)...), nil
+}
+
+// RSToSignature converts a raw 64-byte r || s signature to ASN.1 DER.
+func RSToSignature(raw []byte) ([]byte, error) {
+	if len(raw) != 64 {
+		return nil, errors.New("SM2: raw signature must be 64 bytes")
+	}
+	r := new(big.Int).SetBytes(raw[:32])
+	s := new(big.Int).SetBytes(raw[32:])
+	return SignDigitToSignData(r, s)
+}
+
+// DetectNonceReuse reports whether the signatures (r1, s1) of msg1 and
+// (r2, s2) of msg2 by pub were made with the same nonce k, which leaks the
+// private key.
+//
+// SM2 computes r = (e + x1) mod n, so two messages signed with the same k
+// have different r. Instead the nonce point [k]G = [s]G + [r + s]P is
+// recovered from each signature and compared, which does not depend on the
+// user ID the messages were signed with. The same message with the same
+// signature, as a log may record it twice, is not reported.
+func DetectNonceReuse(pub *PublicKey, msg1, msg2 []byte, r1, s1, r2, s2 *big.Int) bool {
+	if nilPublicKey(pub) || !isSM2Curve(pub.Curve) {
+		return false
+	}
+	if r1 == nil || s1 == nil || r2 == nil || s2 == nil {
+		return false
+	}
+	if bytes.Equal(msg1, msg2) && r1.Cmp(r2) == 0 && s1.Cmp(s2) == 0 {
+		return false
+	}
+	x1, y1, ok1 := noncePoint(pub, r1, s1)
+	x2, y2, ok2 := noncePoint(pub, r2, s2)
+	return ok1 && ok2 && x1.Cmp(x2) == 0 && y1.Cmp(y2) == 0
+}
+
+// noncePoint computes [s]G + [r + s]P
+func noncePoint(pub *PublicKey, r, s *big.Int) (x, y *big.Int, ok bool) {
+	c := pub.Curve
+	N := c.Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(N) >= 0 || s.Cmp(N) >= 0 {
+		return nil, nil, false
+	}
 	t := new(big.Int).Add(r, s)
 	t.Mod(t, N)
 	if t.Sign() == 0 {
-		return false
+		return nil, nil, false
 	}
-	var x *big.Int
 	x1, y1 := c.ScalarBaseMult(s.Bytes())
 	x2, y2 := c.ScalarMult(pub.X, pub.Y, t.Bytes())
-	x, _ = c.Add(x1, y1, x2, y2)
-
-	x.Add(x, e)
-	x.Mod(x, N)
-	return x.Cmp(r) == 0
+	x, y = c.Add(x1, y1, x2, y2)
+	return x, y, true
 }
 
 func msgHash(za, msg []byte) (*big.Int, error) {
@@ -347,6 +1058,12 @@ func msgHash(za, msg []byte) (*big.Int, error) {
 
 // ZA = H256(ENTLA || IDA || a || b || xG || yG || xA || yA)
 func ZA(pub *PublicKey, uid []byte) ([]byte, error) {
+	if nilPublicKey(pub) {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(pub.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
 	za := sm3.New()
 	uidLen := len(uid)
 	if uidLen >= 8192 {
@@ -356,33 +1073,47 @@ func ZA(pub *PublicKey, uid []byte) ([]byte, error) {
 	za.Write([]byte{byte((Entla >> 8) & 0xFF)})
 	za.Write([]byte{byte(Entla & 0xFF)})
 	za.Write(uid)
-	za.Write(sm2P256ToBig(&sm2P256.a).Bytes())
-	za.Write(sm2P256.B.Bytes())
-	za.Write(sm2P256.Gx.Bytes())
-	za.Write(sm2P256.Gy.Bytes())
-
-	xBuf := pub.X.Bytes()
-	yBuf := pub.Y.Bytes()
-	if n := len(xBuf); n < 32 {
-		xBuf = append(zeroByteSlice[:32-n], xBuf...)
-	}
-	za.Write(xBuf)
-	za.Write(yBuf)
+	params := pub.Curve.Params()
+	za.Write(bigIntTo32Bytes(new(big.Int).Sub(params.P, big.NewInt(3)))) // a = p - 3
+	za.Write(bigIntTo32Bytes(params.B))
+	za.Write(bigIntTo32Bytes(params.Gx))
+	za.Write(bigIntTo32Bytes(params.Gy))
+
+	za.Write(bigIntTo32Bytes(pub.X))
+	za.Write(bigIntTo32Bytes(pub.Y))
 	return za.Sum(nil)[:32], nil
 }
 
-// 32byte
-var zeroByteSlice = []byte{
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
-	0, 0, 0, 0,
+// default user ID, GM/T 0009-2012
+var defaultUid = []byte("1234567812345678")
+
+// ComputeZA returns ZA for pub and uid, the value SM2 signing prepends to
+// the message before hashing. The default user ID 1234567812345678 is used
+// when uid is nil.
+func ComputeZA(pub *PublicKey, uid []byte) ([]byte, error) {
+	if uid == nil {
+		uid = defaultUid
+	}
+	return ZA(pub, uid)
 }
 
+// bigIntTo32Bytes returns x as a big-endian byte slice left-padded to 32
+// bytes
+func bigIntTo32Bytes(x *big.Int) []byte {
+	buf := make([]byte, 32)
+	b := x.Bytes()
+	copy(buf[32-len(b):], b)
+	return buf
+}
+
+const (
+	// C1C3C2 orders the ciphertext as C1 || C3 || C2, GM/T 0003-2012
+	C1C3C2 = 0
+	// C1C2C3 orders the ciphertext as C1 || C2 || C3, the order of the
+	// earlier draft of the standard
+	C1C2C3 = 1
+)
+
 /*
  * sm2密文结构如下:
  *  x
@@ -391,9 +1122,35 @@ var zeroByteSlice = []byte{
  *  CipherText
  */
 func Encrypt(pub *PublicKey, data []byte) ([]byte, error) {
+	return encrypt(pub, data, C1C3C2, sm3.New, kdf)
+}
+
+// EncryptWithMode is like Encrypt but orders the ciphertext as mode, which is
+// C1C3C2 or C1C2C3.
+func EncryptWithMode(pub *PublicKey, data []byte, mode int) ([]byte, error) {
+	return encrypt(pub, data, mode, sm3.New, kdf)
+}
+
+// c3Hash computes C3 = Hash(x2 || M || y2). The standard hash is SM3.
+func c3Hash(newHash func() hash.Hash, x2, msg, y2 []byte) []byte {
+	h := newHash()
+	h.Write(x2)
+	h.Write(msg)
+	h.Write(y2)
+	return h.Sum(nil)
+}
+
+// encrypt derives the key stream with keyStream, which is kdf except in
+// tests that force an all-zero key stream.
+func encrypt(pub *PublicKey, data []byte, mode int, newHash func() hash.Hash, keyStream func(int, ...[]byte) ([]byte, bool)) ([]byte, error) {
+	if err := ValidatePublicKey(pub); err != nil {
+		return nil, err
+	}
+	if mode != C1C3C2 && mode != C1C2C3 {
+		return nil, errors.New("SM2: unknown ciphertext mode")
+	}
 	length := len(data)
 	for {
-		c := []byte{}
 		curve := pub.Curve
 		k, err := randFieldElement(curve, rand.Reader)
 		if err != nil {
@@ -401,72 +1158,278 @@ func Encrypt(pub *PublicKey, data []byte) ([]byte, error) {
 		}
 		x1, y1 := curve.ScalarBaseMult(k.Bytes())
 		x2, y2 := curve.ScalarMult(pub.X, pub.Y, k.Bytes())
-		x1Buf := x1.Bytes()
-		y1Buf := y1.Bytes()
-		x2Buf := x2.Bytes()
-		y2Buf := y2.Bytes()
-		if n := len(x1Buf); n < 32 {
-			x1Buf = append(zeroByteSlice[:32-n], x1Buf...)
-		}
-		if n := len(y1Buf); n < 32 {
-			y1Buf = append(zeroByteSlice[:32-n], y1Buf...)
-		}
-		if n := len(x2Buf); n < 32 {
-			x2Buf = append(zeroByteSlice[:32-n], x2Buf...)
-		}
-		if n := len(y2Buf); n < 32 {
-			y2Buf = append(zeroByteSlice[:32-n], y2Buf...)
-		}
-		c = append(c, x1Buf...) // x分量
-		c = append(c, y1Buf...) // y分量
-		tm := []byte{}
-		tm = append(tm, x2Buf...)
-		tm = append(tm, data...)
-		tm = append(tm, y2Buf...)
-		h := sm3.Sm3Sum(tm)
-		c = append(c, h...)
-		ct, ok := kdf(x2Buf, y2Buf, length) // 密文
-		if !ok {
-			continue
+		x2Buf := bigIntTo32Bytes(x2)
+		y2Buf := bigIntTo32Bytes(y2)
+		// An empty message has an empty C2, so no key stream is derived
+		// and C3 is SM3(x2 || y2).
+		ct := []byte{}
+		if length > 0 {
+			var ok bool
+			if ct, ok = keyStream(length, x2Buf, y2Buf); !ok { // 密文
+				continue
+			}
 		}
-		c = append(c, ct...)
 		for i := 0; i < length; i++ {
-			c[96+i] ^= data[i]
+			ct[i] ^= data[i]
+		}
+		h := c3Hash(newHash, x2Buf, data, y2Buf)
+		c := make([]byte, 0, 96+length)
+		c = append(c, bigIntTo32Bytes(x1)...) // x分量
+		c = append(c, bigIntTo32Bytes(y1)...) // y分量
+		if mode == C1C2C3 {
+			c = append(c, ct...)
+			c = append(c, h...)
+		} else {
+			c = append(c, h...)
+			c = append(c, ct...)
 		}
 		return c, nil
 	}
 }
 
 func Decrypt(priv *PrivateKey, data []byte) ([]byte, error) {
+	return decrypt(priv, data, C1C3C2, false, sm3.New, kdf)
+}
+
+// DecryptWithMode is like Decrypt for a ciphertext ordered as mode, which is
+// C1C3C2 or C1C2C3.
+func DecryptWithMode(priv *PrivateKey, data []byte, mode int) ([]byte, error) {
+	return decrypt(priv, data, mode, false, sm3.New, kdf)
+}
+
+// DecryptLenient is like DecryptWithMode but also accepts C1 as a 65-byte
+// uncompressed point with the 0x04 prefix or a 33-byte compressed point, as
+// some other implementations emit it, besides the bare 64-byte x || y used
+// by this package.
+func DecryptLenient(priv *PrivateKey, data []byte, mode int) ([]byte, error) {
+	return decrypt(priv, data, mode, true, sm3.New, kdf)
+}
+
+// bareC1 returns data with a SEC1 encoded C1 rewritten to the bare x || y
+// form. The bare form is tried first, since x may start with any byte.
+func bareC1(c elliptic.Curve, data []byte) []byte {
+	if len(data) >= 64 &&
+		c.IsOnCurve(new(big.Int).SetBytes(data[:32]), new(big.Int).SetBytes(data[32:64])) {
+		return data
+	}
+	switch {
+	case len(data) >= 97 && data[0] == 4:
+		if c.IsOnCurve(new(big.Int).SetBytes(data[1:33]), new(big.Int).SetBytes(data[33:65])) {
+			return data[1:]
+		}
+	case len(data) >= 65 && (data[0] == 2 || data[0] == 3):
+		if pub := Decompress(data[:33]); pub != nil {
+			c1 := append(bigIntTo32Bytes(pub.X), bigIntTo32Bytes(pub.Y)...)
+			return append(c1, data[33:]...)
+		}
+	}
+	return data
+}
+
+func decrypt(priv *PrivateKey, data []byte, mode int, lenient bool, newHash func() hash.Hash, keyStream func(int, ...[]byte) ([]byte, bool)) ([]byte, error) {
+	if nilPrivateKey(priv) {
+		return nil, ErrNilKey
+	}
+	if !isSM2Curve(priv.Curve) {
+		return nil, ErrUnsupportedCurve
+	}
+	if mode != C1C3C2 && mode != C1C2C3 {
+		return nil, errors.New("SM2: unknown ciphertext mode")
+	}
+	if lenient {
+		data = bareC1(priv.Curve, data)
+	}
+	// C1 is 64 bytes and C3 32 bytes, C2 is empty for an empty message
+	if len(data) < 96 {
+		return nil, errors.New("Decrypt: invalid ciphertext length")
+	}
 	length := len(data) - 96
+	var c3, ct []byte
+	if mode == C1C2C3 {
+		ct, c3 = data[64:64+length], data[64+length:]
+	} else {
+		c3, ct = data[64:96], data[96:]
+	}
 	curve := priv.Curve
 	x := new(big.Int).SetBytes(data[:32])
 	y := new(big.Int).SetBytes(data[32:64])
+	if P := curve.Params().P; x.Cmp(P) >= 0 || y.Cmp(P) >= 0 || !curve.IsOnCurve(x, y) {
+		return nil, errors.New("Decrypt: C1 is not a point on the curve")
+	}
 	x2, y2 := curve.ScalarMult(x, y, priv.D.Bytes())
-	x2Buf := x2.Bytes()
-	y2Buf := y2.Bytes()
-	if n := len(x2Buf); n < 32 {
-		x2Buf = append(zeroByteSlice[:32-n], x2Buf...)
+	x2Buf := bigIntTo32Bytes(x2)
+	y2Buf := bigIntTo32Bytes(y2)
+
+	c := []byte{}
+	if length > 0 {
+		var ok bool
+		if c, ok = keyStream(length, x2Buf, y2Buf); !ok {
+			return nil, errors.New("Decrypt: failed to decrypt")
+		}
+	}
+	for i := 0; i < length; i++ {
+		c[i] ^= ct[i]
+	}
+	h := c3Hash(newHash, x2Buf, c, y2Buf)
+	if subtle.ConstantTimeCompare(h, c3) != 1 {
+		return nil, errors.New("Decrypt: C3 does not match")
 	}
-	if n := len(y2Buf); n < 32 {
-		y2Buf = append(zeroByteSlice[:32-n], y2Buf...)
+	return c, nil
+}
+
+// sm2Cipher is the ASN.1 structure of SM2 ciphertext, GM/T 0009-2012
+type sm2Cipher struct {
+	XCoordinate *big.Int
+	YCoordinate *big.Int
+	HASH        []byte
+	CipherText  []byte
+}
+
+// EncryptASN1 encrypts data with pub and returns the ciphertext in the
+// ASN.1 DER form of GM/T 0009.
+func EncryptASN1(pub *PublicKey, data []byte) ([]byte, error) {
+	c, err := Encrypt(pub, data)
+	if err != nil {
+		return nil, err
 	}
+	return CipherMarshal(c)
+}
 
-	c, ok := kdf(x2Buf, y2Buf, length)
-	if !ok {
-		return nil, errors.New("Decrypt: failed to decrypt")
+// DecryptASN1 decrypts ciphertext in the ASN.1 DER form of GM/T 0009.
+func DecryptASN1(priv *PrivateKey, data []byte) ([]byte, error) {
+	c, err := CipherUnmarshal(data)
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; i < length; i++ {
-		c[i] ^= data[i+96]
+	return Decrypt(priv, c)
+}
+
+// Ciphertext encodings of EncryptOpts.
+const (
+	// ASN1Encoding is the ASN.1 DER form of GM/T 0009, see EncryptASN1.
+	ASN1Encoding = iota
+	// RawEncoding is the concatenation of C1, C2 and C3 in the order of
+	// EncryptOpts.Mode, see Encrypt.
+	RawEncoding
+	// AutoEncoding, for decryption only, accepts both. A ciphertext that
+	// starts with an ASN.1 SEQUENCE and parses as one is taken as ASN.1.
+	AutoEncoding
+)
+
+// EncryptOpts selects the ciphertext format of EncryptWithOpts and
+// DecryptWithOpts. Not to be confused with EncryptOptions, which configures
+// the encryption of private keys. A nil *EncryptOpts, like the zero value,
+// selects ASN.1.
+type EncryptOpts struct {
+	Encoding int
+	// Mode is C1C3C2 or C1C2C3, it is only used by the raw encoding.
+	Mode int
+	// Hash computes C3 instead of SM3, to interoperate with implementations
+	// that do not follow the standard, such as ones using SHA-256. Its
+	// digests must be 32 bytes long, like those of SM3. nil selects SM3.
+	Hash func() hash.Hash
+}
+
+// c3Hash returns the C3 hash selected by opts.
+func (opts *EncryptOpts) c3Hash() (func() hash.Hash, error) {
+	if opts.Hash == nil {
+		return sm3.New, nil
+	}
+	if opts.Hash().Size() != 32 {
+		return nil, errors.New("SM2: C3 hash must have 32-byte digests")
+	}
+	return opts.Hash, nil
+}
+
+// EncryptWithOpts encrypts msg with pub, producing the ciphertext format
+// selected by opts.
+func EncryptWithOpts(pub *PublicKey, msg []byte, opts *EncryptOpts) ([]byte, error) {
+	if opts == nil {
+		opts = &EncryptOpts{}
+	}
+	newHash, err := opts.c3Hash()
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Encoding {
+	case ASN1Encoding:
+		c, err := encrypt(pub, msg, C1C3C2, newHash, kdf)
+		if err != nil {
+			return nil, err
+		}
+		return CipherMarshal(c)
+	case RawEncoding:
+		return encrypt(pub, msg, opts.Mode, newHash, kdf)
+	}
+	return nil, errors.New("SM2: unknown ciphertext encoding")
+}
+
+// DecryptWithOpts decrypts a ciphertext in the format selected by opts.
+func DecryptWithOpts(priv *PrivateKey, ct []byte, opts *EncryptOpts) ([]byte, error) {
+	if opts == nil {
+		opts = &EncryptOpts{}
+	}
+	newHash, err := opts.c3Hash()
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Encoding {
+	case ASN1Encoding:
+		c, err := CipherUnmarshal(ct)
+		if err != nil {
+			return nil, err
+		}
+		return decrypt(priv, c, C1C3C2, false, newHash, kdf)
+	case RawEncoding:
+		return decrypt(priv, ct, opts.Mode, false, newHash, kdf)
+	case AutoEncoding:
+		// a raw C1 may start with 0x30 as well
+		if len(ct) > 0 && ct[0] == 0x30 {
+			if c, err := CipherUnmarshal(ct); err == nil {
+				return decrypt(priv, c, C1C3C2, false, newHash, kdf)
+			}
+		}
+		return decrypt(priv, ct, opts.Mode, false, newHash, kdf)
 	}
-	tm := []byte{}
-	tm = append(tm, x2Buf...)
-	tm = append(tm, c...)
-	tm = append(tm, y2Buf...)
-	h := sm3.Sm3Sum(tm)
-	if bytes.Compare(h, data[64:96]) != 0 {
-		return c, errors.New("Decrypt: failed to decrypt")
+	return nil, errors.New("SM2: unknown ciphertext encoding")
+}
+
+// CipherMarshal converts raw C1C3C2 ciphertext to the ASN.1 DER form of
+// GM/T 0009.
+func CipherMarshal(data []byte) ([]byte, error) {
+	if len(data) < 96 {
+		return nil, errors.New("SM2: invalid ciphertext length")
 	}
+	return asn1.Marshal(sm2Cipher{
+		XCoordinate: new(big.Int).SetBytes(data[:32]),
+		YCoordinate: new(big.Int).SetBytes(data[32:64]),
+		HASH:        data[64:96],
+		CipherText:  data[96:],
+	})
+}
+
+// CipherUnmarshal converts ciphertext in the ASN.1 DER form of GM/T 0009
+// to raw C1C3C2.
+func CipherUnmarshal(data []byte) ([]byte, error) {
+	var sm2c sm2Cipher
+
+	rest, err := asn1.Unmarshal(data, &sm2c)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("SM2: trailing data after ciphertext")
+	}
+	if sm2c.XCoordinate.Sign() < 0 || sm2c.XCoordinate.BitLen() > 256 ||
+		sm2c.YCoordinate.Sign() < 0 || sm2c.YCoordinate.BitLen() > 256 ||
+		len(sm2c.HASH) != 32 {
+		return nil, errors.New("SM2: invalid ciphertext")
+	}
+	c := make([]byte, 0, 96+len(sm2c.CipherText))
+	c = append(c, bigIntTo32Bytes(sm2c.XCoordinate)...)
+	c = append(c, bigIntTo32Bytes(sm2c.YCoordinate)...)
+	c = append(c, sm2c.HASH...)
+	c = append(c, sm2c.CipherText...)
 	return c, nil
 }
 
@@ -487,33 +1450,62 @@ func getLastBit(a *big.Int) uint {
 	return a.Bit(0)
 }
 
+// CompressPoint returns the SEC 1 compressed form 02 || x or 03 || x of the
+// point (x, y) of the SM2 curve, by the parity of y, or nil if x or y is
+// nil.
+func CompressPoint(x, y *big.Int) []byte {
+	if x == nil || y == nil {
+		return nil
+	}
+	return append([]byte{2 | byte(y.Bit(0))}, bigIntTo32Bytes(x)...)
+}
+
+// DecompressPoint returns the point of the SM2 curve of a compressed point
+// written by CompressPoint. As P = 3 mod 4, the square root of
+// x^3 + ax + b is its (P+1)/4th power; the root with the parity of the
+// prefix byte is taken.
+func DecompressPoint(data []byte) (x, y *big.Int, err error) {
+	if len(data) != 33 || (data[0] != 2 && data[0] != 3) {
+		return nil, nil, errors.New("SM2: invalid compressed point")
+	}
+	params := P256Sm2().Params()
+	x = new(big.Int).SetBytes(data[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil, nil, errors.New("SM2: invalid compressed point")
+	}
+	y2 := new(big.Int).Mul(x, x)
+	y2.Sub(y2, big.NewInt(3)) // a = -3
+	y2.Mul(y2, x)
+	y2.Add(y2, params.B)
+	y2.Mod(y2, params.P)
+	e := new(big.Int).Add(params.P, one)
+	y = new(big.Int).Exp(y2, e.Rsh(e, 2), params.P)
+	if check := new(big.Int).Mul(y, y); check.Mod(check, params.P).Cmp(y2) != 0 {
+		return nil, nil, errors.New("SM2: compressed point is not on curve")
+	}
+	if y.Bit(0) != uint(data[0]&1) {
+		y.Sub(params.P, y)
+	}
+	return x, y, nil
+}
+
 func Compress(a *PublicKey) []byte {
-	buf := []byte{}
-	yp := getLastBit(a.Y)
-	buf = append(buf, a.X.Bytes()...)
-	if n := len(a.X.Bytes()); n < 32 {
-		buf = append(zeroByteSlice[:(32-n)], buf...)
+	if nilPublicKey(a) {
+		return nil
 	}
-	buf = append([]byte{byte(yp)}, buf...)
-	return buf
+	yp := getLastBit(a.Y)
+	return append([]byte{byte(yp)}, bigIntTo32Bytes(a.X)...)
 }
 
+// Decompress returns the point of a compressed key, or nil if there is none.
+// The prefix byte is 0 or 1 as written by Compress, or 02 or 03 as in SEC 1.
 func Decompress(a []byte) *PublicKey {
-	var aa, xx, xx3 sm2P256FieldElement
-
-	x := new(big.Int).SetBytes(a[1:])
-	curve := sm2P256
-	sm2P256FromBig(&xx, x)
-	sm2P256Square(&xx3, &xx)       // x3 = x ^ 2
-	sm2P256Mul(&xx3, &xx3, &xx)    // x3 = x ^ 2 * x
-	sm2P256Mul(&aa, &curve.a, &xx) // a = a * x
-	sm2P256Add(&xx3, &xx3, &aa)
-	sm2P256Add(&xx3, &xx3, &curve.b)
-
-	y2 := sm2P256ToBig(&xx3)
-	y := new(big.Int).ModSqrt(y2, sm2P256.P)
-	if getLastBit(y) != uint(a[0]) {
-		y.Sub(sm2P256.P, y)
+	if len(a) != 33 {
+		return nil
+	}
+	x, y, err := DecompressPoint(append([]byte{2 | a[0]&1}, a[1:]...))
+	if err != nil {
+		return nil // x is not the coordinate of a point
 	}
 	return &PublicKey{
 		Curve: P256Sm2(),
@@ -0,0 +1,214 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm2
+
+// Two-party SM2 signing. Neither party holds the private key d; party i
+// holds a share di with d1 * d2 = (1 + d)^-1 mod n, the multiplicative
+// sharing of the published two-party SM2 schemes, which makes signing a
+// single round trip:
+//
+//	party 1: k1, Q1 = [k1]G                          -> Q1, e
+//	party 2: k2, k3, (x1, y1) = [k3]Q1 + [k2]G
+//	         r = (e + x1) mod n
+//	         s2 = d2 * k3, s3 = d2 * (r + k2)         -> r, s2, s3
+//	party 1: s = d1 * k1 * s2 + d1 * s3 - r mod n
+//
+// so that s = (1 + d)^-1 * (k + r) - r = (1 + d)^-1 * (k - r * d) for the
+// nonce k = k1 * k3 + k2, a standard SM2 signature by P = [d]G.
+//
+// The protocol is secure against parties that follow it. There are no
+// zero knowledge proofs, so a malicious party can make signing fail or
+// bias the joint key; party 1 verifies every signature before returning it.
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// KeyShare is one party's share of a two-party SM2 key.
+type KeyShare struct {
+	// D is the secret share d1 or d2, with d1 * d2 = (1 + d)^-1 mod n.
+	D *big.Int
+	// Partial is [D^-1]G, which is sent to the other party.
+	Partial PublicKey
+	// PublicKey is the joint public key [d]G, set by Combine.
+	PublicKey PublicKey
+}
+
+// GenerateKeyShare generates a party's key share, reading randomness from
+// random. crypto/rand.Reader is used when random is nil. The parties
+// exchange their Partial keys and call Combine with the other's.
+func GenerateKeyShare(random io.Reader) (*KeyShare, error) {
+	priv, err := GenerateKeyWithReader(random)
+	if err != nil {
+		return nil, err
+	}
+	c := priv.Curve
+	dInv := new(big.Int).ModInverse(priv.D, c.Params().N)
+	share := &KeyShare{D: dInv}
+	share.Partial.Curve = c
+	share.Partial.X, share.Partial.Y = priv.X, priv.Y // [D^-1]G
+	return share, nil
+}
+
+// Combine computes the joint public key P = [D^-1]other - G from the
+// Partial key of the other party, stores it in share.PublicKey and returns
+// it. Both parties obtain the same key.
+func (share *KeyShare) Combine(other *PublicKey) (*PublicKey, error) {
+	if err := ValidatePublicKey(other); err != nil {
+		return nil, errors.New("SM2: other party's partial key: " + err.Error())
+	}
+	c := share.Partial.Curve
+	params := c.Params()
+	dInv := new(big.Int).ModInverse(share.D, params.N)
+	x, y := c.ScalarMult(other.X, other.Y, dInv.Bytes())
+	// -G = (Gx, p - Gy)
+	x, y = c.Add(x, y, params.Gx, new(big.Int).Sub(params.P, params.Gy))
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return nil, errors.New("SM2: joint private key is zero")
+	}
+	share.PublicKey = PublicKey{Curve: c, X: x, Y: y}
+	return &share.PublicKey, nil
+}
+
+// Digest returns e = SM3(ZA || msg) for the joint public key, the value
+// party 1 starts signing with. Party 2 should recompute it from the
+// message it agreed to sign and compare it with SignRequest.Digest. The
+// default user ID is used when uid is nil.
+func (share *KeyShare) Digest(msg, uid []byte) ([]byte, error) {
+	za, err := ComputeZA(&share.PublicKey, uid)
+	if err != nil {
+		return nil, err
+	}
+	e, err := msgHash(za, msg)
+	if err != nil {
+		return nil, err
+	}
+	return bigIntTo32Bytes(e), nil
+}
+
+// SignRequest is the message of party 1 that starts a signature.
+type SignRequest struct {
+	Digest []byte // e = SM3(ZA || M)
+	Q1     PublicKey
+}
+
+// SignResponse is the answer of party 2 to a SignRequest.
+type SignResponse struct {
+	R, S2, S3 *big.Int
+}
+
+// SignSession holds the state of party 1 between StartSign and Finish. A
+// session signs one message only.
+type SignSession struct {
+	share  *KeyShare
+	digest []byte
+	k1     *big.Int
+}
+
+// StartSign begins a signature of digest, see Digest, by party 1. The
+// request is sent to party 2 and its response passed to session.Finish.
+func (share *KeyShare) StartSign(random io.Reader, digest []byte) (*SignRequest, *SignSession, error) {
+	if err := ValidatePublicKey(&share.PublicKey); err != nil {
+		return nil, nil, err
+	}
+	if len(digest) != 32 {
+		return nil, nil, errors.New("SM2: digest must be 32 bytes")
+	}
+	k1, err := GenerateKeyWithReader(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &SignRequest{
+		Digest: append([]byte{}, digest...),
+		Q1:     k1.PublicKey,
+	}
+	session := &SignSession{
+		share:  share,
+		digest: req.Digest,
+		k1:     k1.D,
+	}
+	return req, session, nil
+}
+
+// RespondSign is party 2's half of a signature: it answers req with r and
+// its contributions to s.
+func (share *KeyShare) RespondSign(random io.Reader, req *SignRequest) (*SignResponse, error) {
+	if err := ValidatePublicKey(&req.Q1); err != nil {
+		return nil, errors.New("SM2: party 1's nonce point: " + err.Error())
+	}
+	if len(req.Digest) != 32 {
+		return nil, errors.New("SM2: digest must be 32 bytes")
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+	c := share.Partial.Curve
+	N := c.Params().N
+	e := new(big.Int).SetBytes(req.Digest)
+	for {
+		k2, err := randFieldElement(c, random)
+		if err != nil {
+			return nil, err
+		}
+		k3, err := randFieldElement(c, random)
+		if err != nil {
+			return nil, err
+		}
+		// (x1, y1) = [k3]Q1 + [k2]G
+		x, y := c.ScalarMult(req.Q1.X, req.Q1.Y, k3.Bytes())
+		x2, y2 := c.ScalarBaseMult(k2.Bytes())
+		x1, _ := c.Add(x, y, x2, y2)
+		r := x1.Add(x1, e)
+		r.Mod(r, N)
+		if r.Sign() == 0 {
+			continue
+		}
+		s2 := new(big.Int).Mul(share.D, k3)
+		s2.Mod(s2, N)
+		s3 := new(big.Int).Add(r, k2)
+		s3.Mul(s3, share.D)
+		s3.Mod(s3, N)
+		return &SignResponse{R: r, S2: s2, S3: s3}, nil
+	}
+}
+
+// Finish completes the signature with party 2's response and returns it
+// after checking that it verifies with the joint public key.
+func (session *SignSession) Finish(resp *SignResponse) (r, s *big.Int, err error) {
+	if session.k1 == nil {
+		return nil, nil, errors.New("SM2: signing session already used")
+	}
+	k1 := session.k1
+	session.k1 = nil
+	if resp == nil || resp.R == nil || resp.S2 == nil || resp.S3 == nil {
+		return nil, nil, errors.New("SM2: incomplete signing response")
+	}
+	share := session.share
+	N := share.Partial.Curve.Params().N
+	// s = d1 * k1 * s2 + d1 * s3 - r
+	s = new(big.Int).Mul(k1, resp.S2)
+	s.Add(s, resp.S3)
+	s.Mul(s, share.D)
+	s.Sub(s, resp.R)
+	s.Mod(s, N)
+	r = new(big.Int).Set(resp.R)
+	if !VerifyDigest(&share.PublicKey, session.digest, r, s) {
+		return nil, nil, errors.New("SM2: two-party signature does not verify")
+	}
+	return r, s, nil
+}
@@ -28,6 +28,7 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
@@ -38,7 +39,6 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net"
-	"os"
 	"strconv"
 	"time"
 
@@ -72,7 +72,7 @@ func ParsePKIXPublicKey(derBytes []byte) (pub interface{}, err error) {
 	}
 	algo := getPublicKeyAlgorithmFromOID(pki.Algorithm.Algorithm)
 	if algo == UnknownPublicKeyAlgorithm {
-		return nil, errors.New("x509: unknown public key algorithm")
+		return nil, UnsupportedAlgorithmError{"public key algorithm", pki.Algorithm.Algorithm}
 	}
 	return parsePublicKey(algo, &pki)
 }
@@ -107,6 +107,9 @@ func marshalPublicKey(pub interface{}) (publicKeyBytes []byte, publicKeyAlgorith
 		}
 		publicKeyAlgorithm.Parameters.FullBytes = paramBytes
 	case *PublicKey:
+		if nilPublicKey(pub) {
+			return nil, pkix.AlgorithmIdentifier{}, ErrNilKey
+		}
 		publicKeyBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 		oid, ok := oidFromNamedCurve(pub.Curve)
 		if !ok {
@@ -965,6 +968,22 @@ func (c *Certificate) CheckSignature(algo SignatureAlgorithm, signed, signature
 	return checkSignature(algo, signed, signature, c.PublicKey)
 }
 
+// CheckSM2Signature is like CheckSignature but requires c to hold an SM2
+// public key and algo to be an SM2 signature algorithm, and says so in the
+// error when they are not.
+func (c *Certificate) CheckSM2Signature(algo SignatureAlgorithm, signed, signature []byte) error {
+	switch algo {
+	case SM2WithSM3, SM2WithSHA1, SM2WithSHA256:
+	default:
+		return fmt.Errorf("x509: %v is not an SM2 signature algorithm", algo)
+	}
+	pub, err := ParseSm2PublicKey(c.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return fmt.Errorf("x509: certificate does not hold an SM2 public key: %v", err)
+	}
+	return checkSignature(algo, signed, signature, pub)
+}
+
 // CheckSignature verifies that signature is a valid signature over signed from
 // a crypto.PublicKey.
 func checkSignature(algo SignatureAlgorithm, signed, signature []byte, publicKey crypto.PublicKey) (err error) {
@@ -990,10 +1009,10 @@ func checkSignature(algo SignatureAlgorithm, signed, signature []byte, publicKey
 	if !hashType.Available() {
 		return ErrUnsupportedAlgorithm
 	}
-	h := hashType.New()
-
-	h.Write(signed)
-	digest := h.Sum(nil)
+	digest, err := signedDigest(hashType, publicKey, signed)
+	if err != nil {
+		return err
+	}
 
 	switch pub := publicKey.(type) {
 	case *rsa.PublicKey:
@@ -1028,7 +1047,7 @@ func checkSignature(algo SignatureAlgorithm, signed, signature []byte, publicKey
 		}
 		switch pub.Curve {
 		case P256Sm2():
-			if !Verify(&PublicKey{
+			if !VerifyDigest(&PublicKey{
 				Curve: pub.Curve,
 				X:     pub.X,
 				Y:     pub.Y,
@@ -1041,10 +1060,53 @@ func checkSignature(algo SignatureAlgorithm, signed, signature []byte, publicKey
 			}
 		}
 		return
+	case *PublicKey:
+		r, s, err := SignDataToSignDigit(signature)
+		if err != nil {
+			return err
+		}
+		if r.Sign() <= 0 || s.Sign() <= 0 {
+			return errors.New("x509: SM2 signature contained zero or negative values")
+		}
+		if !VerifyDigest(pub, digest, r, s) {
+			return errors.New("x509: SM2 verification failure")
+		}
+		return nil
 	}
 	return ErrUnsupportedAlgorithm
 }
 
+// signedDigest hashes signed with hashFunc. For SM2 keys with SM3 the user
+// ID hash ZA of the default ID is hashed first, as GM/T 0015 requires for
+// certificates, requests and CRLs.
+func signedDigest(hashFunc Hash, pub crypto.PublicKey, signed []byte) ([]byte, error) {
+	h := hashFunc.New()
+	if hashFunc == SM3 {
+		var sm2Pub *PublicKey
+		switch pub := pub.(type) {
+		case *PublicKey:
+			sm2Pub = pub
+		case *ecdsa.PublicKey:
+			if pub.Curve == P256Sm2() {
+				sm2Pub = &PublicKey{
+					Curve: pub.Curve,
+					X:     pub.X,
+					Y:     pub.Y,
+				}
+			}
+		}
+		if sm2Pub != nil {
+			za, err := ComputeZA(sm2Pub, nil)
+			if err != nil {
+				return nil, err
+			}
+			h.Write(za)
+		}
+	}
+	h.Write(signed)
+	return h.Sum(nil), nil
+}
+
 // CheckCRLSignature checks that the signature in crl is from c.
 func (c *Certificate) CheckCRLSignature(crl *pkix.CertificateList) error {
 	algo := getSignatureAlgorithmFromAI(crl.SignatureAlgorithm)
@@ -1172,7 +1234,7 @@ func parsePublicKey(algo PublicKeyAlgorithm, keyData *publicKeyInfo) (interface{
 		}
 		namedCurve := namedCurveFromOID(*namedCurveOID)
 		if namedCurve == nil {
-			return nil, errors.New("x509: unsupported elliptic curve")
+			return nil, UnsupportedAlgorithmError{"named curve", *namedCurveOID}
 		}
 		x, y := elliptic.Unmarshal(namedCurve, asn1Data)
 		if x == nil {
@@ -1956,9 +2018,10 @@ func CreateCertificate(rand io.Reader, template, parent *Certificate, pub, priv
 
 	c.Raw = tbsCertContents
 
-	h := hashFunc.New()
-	h.Write(tbsCertContents)
-	digest := h.Sum(nil)
+	digest, err := signedDigest(hashFunc, key.Public(), tbsCertContents)
+	if err != nil {
+		return
+	}
 
 	var signerOpts crypto.SignerOpts
 	signerOpts = hashFunc
@@ -2035,10 +2098,20 @@ func (c *Certificate) CreateCRL(rand io.Reader, priv interface{}, revokedCerts [
 		revokedCertsUTC[i] = rc
 	}
 
+	// Use the subject as encoded in the certificate: rebuilding it from
+	// c.Subject loses the order of its attributes, and the CRL issuer
+	// would then not match the certificate.
+	issuer := c.Subject.ToRDNSequence()
+	if len(c.RawSubject) > 0 {
+		if _, err := asn1.Unmarshal(c.RawSubject, &issuer); err != nil {
+			return nil, err
+		}
+	}
+
 	tbsCertList := pkix.TBSCertificateList{
 		Version:             1,
 		Signature:           signatureAlgorithm,
-		Issuer:              c.Subject.ToRDNSequence(),
+		Issuer:              issuer,
 		ThisUpdate:          now.UTC(),
 		NextUpdate:          expiry.UTC(),
 		RevokedCertificates: revokedCertsUTC,
@@ -2060,9 +2133,10 @@ func (c *Certificate) CreateCRL(rand io.Reader, priv interface{}, revokedCerts [
 		return
 	}
 
-	h := hashFunc.New()
-	h.Write(tbsCertListContents)
-	digest := h.Sum(nil)
+	digest, err := signedDigest(hashFunc, key.Public(), tbsCertListContents)
+	if err != nil {
+		return
+	}
 
 	var signature []byte
 	signature, err = key.Sign(rand, digest, hashFunc)
@@ -2077,6 +2151,56 @@ func (c *Certificate) CreateCRL(rand io.Reader, priv interface{}, revokedCerts [
 	})
 }
 
+// CreateCRL returns a DER encoded CRL listing revokedCerts, signed with
+// SM2WithSM3 by priv, the private key of issuerCert.
+func CreateCRL(priv *PrivateKey, issuerCert *Certificate, revokedCerts []pkix.RevokedCertificate, now, expiry time.Time) ([]byte, error) {
+	if nilPrivateKey(priv) {
+		return nil, ErrNilKey
+	}
+	if issuerCert == nil {
+		return nil, errors.New("x509: nil issuer certificate")
+	}
+	pub, err := ParseSm2PublicKey(issuerCert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		return nil, errors.New("x509: private key does not match public key of the issuer")
+	}
+	return issuerCert.CreateCRL(rand.Reader, priv, revokedCerts, now, expiry)
+}
+
+// CreateCRLToMem is like CreateCRL but returns the CRL as an X509 CRL PEM
+// block.
+func CreateCRLToMem(priv *PrivateKey, issuerCert *Certificate, revokedCerts []pkix.RevokedCertificate, now, expiry time.Time) ([]byte, error) {
+	der, err := CreateCRL(priv, issuerCert, revokedCerts, now, expiry)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type:  pemType,
+		Bytes: der,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParseCRLSignedBy parses a PEM or DER encoded CRL, as ParseCRL does, and
+// returns it only if it is signed with SM2WithSM3 by the key of issuerCert.
+func ParseCRLSignedBy(crlBytes []byte, issuerCert *Certificate) (*pkix.CertificateList, error) {
+	crl, err := ParseCRL(crlBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !crl.SignatureAlgorithm.Algorithm.Equal(oidSignatureSM2WithSM3) ||
+		!crl.TBSCertList.Signature.Algorithm.Equal(oidSignatureSM2WithSM3) {
+		return nil, errors.New("x509: CRL is not signed with SM2WithSM3")
+	}
+	if err := issuerCert.CheckCRLSignature(crl); err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
 // CertificateRequest represents a PKCS #10, certificate signature request.
 type CertificateRequest struct {
 	Raw                      []byte // Complete ASN.1 DER content (CSR, signature algorithm and signature).
@@ -2339,9 +2463,10 @@ func CreateCertificateRequest(rand io.Reader, template *CertificateRequest, priv
 	}
 	tbsCSR.Raw = tbsCSRContents
 
-	h := hashFunc.New()
-	h.Write(tbsCSRContents)
-	digest := h.Sum(nil)
+	digest, err := signedDigest(hashFunc, key.Public(), tbsCSRContents)
+	if err != nil {
+		return
+	}
 
 	var signature []byte
 	signature, err = key.Sign(rand, digest, hashFunc)
@@ -2464,13 +2589,7 @@ func CreateCertificateRequestToPem(FileName string, template *CertificateRequest
 		Type:  "CERTIFICATE REQUEST",
 		Bytes: der,
 	}
-	file, err := os.Create(FileName)
-	if err != nil {
-		return false, err
-	}
-	defer file.Close()
-	err = pem.Encode(file, block)
-	if err != nil {
+	if err := writePEMFile(FileName, block); err != nil {
 		return false, err
 	}
 	return true, nil
@@ -2492,6 +2611,110 @@ func ReadCertificateFromPem(FileName string) (*Certificate, error) {
 	return ReadCertificateFromMem(data)
 }
 
+// ReadPublicKeyFromCertPem decodes a CERTIFICATE PEM block and returns the
+// SM2 public key embedded in the certificate.
+func ReadPublicKeyFromCertPem(data []byte) (*PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode certificate")
+	}
+	return ParseCertificatePublicKey(block.Bytes)
+}
+
+// ParseCertificatePublicKey parses a DER encoded certificate and returns its
+// SM2 public key. The subject public key must be an EC key on the SM2 curve.
+func ParseCertificatePublicKey(der []byte) (*PublicKey, error) {
+	cert, err := ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSm2PublicKey(cert.RawSubjectPublicKeyInfo)
+}
+
+// EncryptForCertificate encrypts msg with EncryptWithOpts to the SM2 public
+// key of the DER encoded certificate. The key is validated first, and a
+// certificate whose key usage extension allows neither key nor data
+// encipherment is rejected; one without the extension is accepted.
+func EncryptForCertificate(certDER, msg []byte, opts *EncryptOpts) ([]byte, error) {
+	cert, err := ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&(KeyUsageKeyEncipherment|KeyUsageDataEncipherment) == 0 {
+		return nil, errors.New("x509: certificate key usage does not allow encryption")
+	}
+	pub, err := ParseSm2PublicKey(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidatePublicKey(pub); err != nil {
+		return nil, err
+	}
+	return EncryptWithOpts(pub, msg, opts)
+}
+
+// ParsePEMBundle walks the PEM blocks of data, such as a file holding a
+// certificate chain and its key, and returns the DER of every CERTIFICATE
+// block, in order, and the first PRIVATE KEY or ENCRYPTED PRIVATE KEY
+// block, decrypted with pwd if needed. Other blocks are skipped. It is an
+// error if there is no key block; certs may be empty.
+func ParsePEMBundle(data []byte, pwd []byte) (certs [][]byte, key *PrivateKey, err error) {
+	for _, block := range pemBlocks(data, certificatePEMTypes) {
+		certs = append(certs, block.Bytes)
+	}
+	keyBlock := findPEMBlock(data, privateKeyPEMTypes)
+	if keyBlock == nil {
+		return nil, nil, errors.New("x509: failed to find a PRIVATE KEY or ENCRYPTED PRIVATE KEY block")
+	}
+	key, err = ParsePKCS8PrivateKey(keyBlock.Bytes, pwd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, key, nil
+}
+
+// X509KeyPair parses a certificate chain and its SM2 private key from PEM
+// data, like tls.X509KeyPair. certPEM holds one or more CERTIFICATE blocks,
+// leaf first; keyPEM holds a PRIVATE KEY or ENCRYPTED PRIVATE KEY block,
+// decrypted with pwd if needed. The key must match the leaf certificate.
+// Leaf is left nil, as crypto/x509 cannot parse SM2 certificates.
+func X509KeyPair(certPEM, keyPEM, pwd []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	for _, block := range pemBlocks(certPEM, certificatePEMTypes) {
+		cert.Certificate = append(cert.Certificate, block.Bytes)
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("x509: failed to find any CERTIFICATE block")
+	}
+	priv, err := ReadPrivateKeyFromPEMBundle(keyPEM, pwd)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pub, err := ParseCertificatePublicKey(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		return tls.Certificate{}, errors.New("x509: private key does not match public key of the certificate")
+	}
+	cert.PrivateKey = priv
+	return cert, nil
+}
+
+// LoadX509KeyPair reads a certificate chain and its SM2 private key from
+// PEM files, like tls.LoadX509KeyPair. See X509KeyPair.
+func LoadX509KeyPair(certFile, keyFile string, pwd []byte) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return X509KeyPair(certPEM, keyPEM, pwd)
+}
+
 func CreateCertificateToMem(template, parent *Certificate, pubKey *PublicKey, privKey *PrivateKey) ([]byte, error) {
 	der, err := CreateCertificate(rand.Reader, template, parent, pubKey, privKey)
 	if err != nil {
@@ -2513,13 +2736,7 @@ func CreateCertificateToPem(FileName string, template, parent *Certificate, pubK
 		Type:  "CERTIFICATE",
 		Bytes: der,
 	}
-	file, err := os.Create(FileName)
-	if err != nil {
-		return false, err
-	}
-	defer file.Close()
-	err = pem.Encode(file, block)
-	if err != nil {
+	if err := writePEMFile(FileName, block); err != nil {
 		return false, err
 	}
 	return true, nil
@@ -0,0 +1,128 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm3
+
+import "errors"
+
+// MerkleTree is a Merkle tree over a list of leaves with the structure of
+// RFC 6962 section 2.1, hashed with SM3 instead of SHA-256. Leaves and
+// interior nodes are hashed with the prefixes 0x00 and 0x01, so a leaf can
+// never be passed off as a node.
+type MerkleTree struct {
+	leaves [][32]byte
+}
+
+// MerkleLeafHash returns SM3(0x00 || data), the hash of a leaf.
+func MerkleLeafHash(data []byte) [32]byte {
+	b := make([]byte, 1+len(data))
+	copy(b[1:], data)
+	return Sum(b)
+}
+
+// merkleNodeHash returns SM3(0x01 || left || right).
+func merkleNodeHash(left, right [32]byte) [32]byte {
+	var b [65]byte
+	b[0] = 0x01
+	copy(b[1:], left[:])
+	copy(b[33:], right[:])
+	return Sum(b[:])
+}
+
+// NewMerkleTree builds the tree over leaves, in order.
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	t := &MerkleTree{leaves: make([][32]byte, len(leaves))}
+	for i, leaf := range leaves {
+		t.leaves[i] = MerkleLeafHash(leaf)
+	}
+	return t
+}
+
+// Len returns the number of leaves.
+func (t *MerkleTree) Len() int { return len(t.leaves) }
+
+// Root returns the root hash. The root of the empty tree is SM3 of the
+// empty string.
+func (t *MerkleTree) Root() [32]byte {
+	if len(t.leaves) == 0 {
+		return Sum(nil)
+	}
+	return merkleRoot(t.leaves)
+}
+
+// merkleSplit returns the largest power of two smaller than n, n > 1.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleRoot(leaves [][32]byte) [32]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// InclusionProof returns the audit path of the leaf at index, from the
+// bottom of the tree up.
+func (t *MerkleTree) InclusionProof(index int) ([][32]byte, error) {
+	if index < 0 || index >= len(t.leaves) {
+		return nil, errors.New("sm3: leaf index out of range")
+	}
+	return merklePath(index, t.leaves), nil
+}
+
+func merklePath(m int, leaves [][32]byte) [][32]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merklePath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// VerifyInclusion reports whether proof shows that leaf is the leaf at
+// index of a tree of size leaves with the given root, following RFC 9162
+// section 2.1.3.2.
+func VerifyInclusion(root [32]byte, index, size int, leaf []byte, proof [][32]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := MerkleLeafHash(leaf)
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && r == root
+}
@@ -17,7 +17,9 @@ package sm3
 
 import (
 	"encoding/binary"
+	"errors"
 	"hash"
+	"io"
 )
 
 type SM3 struct {
@@ -198,6 +200,47 @@ func (sm3 *SM3) Sum(in []byte) []byte {
 
 }
 
+const (
+	magic         = "sm3\x03"
+	marshaledSize = len(magic) + 8*4 + 64 + 8
+)
+
+// MarshalBinary saves the hash state: the registers, the buffered bytes
+// of the last partial block and the message length. It implements
+// encoding.BinaryMarshaler, as the hashes of the standard library do.
+func (sm3 *SM3) MarshalBinary() ([]byte, error) {
+	b := make([]byte, marshaledSize)
+	copy(b, magic)
+	state := b[len(magic):]
+	for i := 0; i < 8; i++ {
+		binary.BigEndian.PutUint32(state[i*4:], sm3.digest[i])
+	}
+	copy(state[32:], sm3.unhandleMsg) // zero padded to a full block
+	binary.BigEndian.PutUint64(state[32+64:], sm3.length)
+	return b, nil
+}
+
+// UnmarshalBinary restores a hash state saved by MarshalBinary.
+func (sm3 *SM3) UnmarshalBinary(b []byte) error {
+	if len(b) < len(magic) || string(b[:len(magic)]) != magic {
+		return errors.New("sm3: invalid hash state identifier")
+	}
+	if len(b) != marshaledSize {
+		return errors.New("sm3: invalid hash state size")
+	}
+	b = b[len(magic):]
+	for i := 0; i < 8; i++ {
+		sm3.digest[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	length := binary.BigEndian.Uint64(b[32+64:])
+	if length%8 != 0 {
+		return errors.New("sm3: invalid hash state length")
+	}
+	sm3.length = length
+	sm3.unhandleMsg = append([]byte{}, b[32:32+length/8%64]...)
+	return nil
+}
+
 func Sm3Sum(data []byte) []byte {
 	var sm3 SM3
 
@@ -205,3 +248,83 @@ func Sm3Sum(data []byte) []byte {
 	sm3.Write(data)
 	return sm3.Sum(nil)
 }
+
+// Sum returns the SM3 digest of data, like sha256.Sum256. Full blocks are
+// hashed in place and the padding is built on the stack, so it does not
+// allocate.
+func Sum(data []byte) [32]byte {
+	var sm3 SM3
+	var tail [128]byte
+	var out [32]byte
+
+	sm3.Reset()
+	n := len(data) &^ 63
+	sm3.update(data[:n], n/64)
+
+	// the last partial block, '1', zeros and the length in bits
+	rest := copy(tail[:], data[n:])
+	tail[rest] = 0x80
+	padLen := 64
+	if rest >= 56 {
+		padLen = 128
+	}
+	binary.BigEndian.PutUint64(tail[padLen-8:], uint64(len(data))*8)
+	sm3.update(tail[:padLen], padLen/64)
+
+	for i := 0; i < 8; i++ {
+		binary.BigEndian.PutUint32(out[i*4:], sm3.digest[i])
+	}
+	return out
+}
+
+// SumReader returns the SM3 digest of everything read from r until io.EOF.
+// It reads through a fixed buffer, so the input is never held in memory as
+// a whole. Data returned together with io.EOF is hashed; any other read
+// error is returned with a zero digest.
+func SumReader(r io.Reader) ([32]byte, error) {
+	var sm3 SM3
+	var buf [32 * 1024]byte
+	var out [32]byte
+
+	sm3.Reset()
+	for {
+		n, err := r.Read(buf[:])
+		sm3.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+	copy(out[:], sm3.Sum(nil))
+	return out, nil
+}
+
+// KDF is the key derivation function of GB/T 32918.4: it returns keyLen
+// bytes of SM3(z || ct) for the 32-bit big endian counter ct = 1, 2, ....
+// It returns nil if the derived key is all zero, which SM2 encryption must
+// reject.
+func KDF(z []byte, keyLen int) []byte {
+	var ct [4]byte
+
+	if keyLen <= 0 {
+		return nil
+	}
+	k := make([]byte, 0, keyLen+32)
+	h := New()
+	for i := uint32(1); len(k) < keyLen; i++ {
+		binary.BigEndian.PutUint32(ct[:], i)
+		h.Reset()
+		h.Write(z)
+		h.Write(ct[:])
+		k = append(k, h.Sum(nil)...)
+	}
+	k = k[:keyLen]
+	for _, b := range k {
+		if b != 0 {
+			return k
+		}
+	}
+	return nil
+}
@@ -16,11 +16,15 @@ limitations under the License.
 package sm3
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"testing/iotest"
 )
 
 func byteToString(b []byte) string {
@@ -52,6 +56,156 @@ func TestSm3(t *testing.T) {
 
 }
 
+// GB/T 32918.4 annex A.2: x2 || y2 and the key stream t for klen = 152
+func TestKDF(t *testing.T) {
+	z, _ := hex.DecodeString("64d20d27d0632957f8028c1e024f6b02edf23102a566c932ae8bd613a8e865fe" +
+		"58d225eca784ae300a81a2d48281a828e1cedf11c4219099840265375077bf78")
+	want, _ := hex.DecodeString("006e30dae231b071dfad8aa379e90264491603")
+	if k := KDF(z, 19); !bytes.Equal(k, want) {
+		t.Errorf("KDF = %x, want %x", k, want)
+	}
+	// longer keys extend the same stream
+	if k := KDF(z, 100); len(k) != 100 || !bytes.Equal(k[:19], want) {
+		t.Errorf("KDF(z, 100) = %x", k)
+	}
+	if k := KDF(z, 0); k != nil {
+		t.Errorf("KDF(z, 0) = %x, want nil", k)
+	}
+}
+
+func TestSum(t *testing.T) {
+	// GB/T 32905 annex A
+	abc := Sum([]byte("abc"))
+	if got := hex.EncodeToString(abc[:]); got != "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0" {
+		t.Errorf("Sum(abc) = %s", got)
+	}
+	msg := make([]byte, 200)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	// lengths around the padding and block boundaries
+	for n := 0; n <= len(msg); n++ {
+		sum := Sum(msg[:n])
+		if want := Sm3Sum(msg[:n]); !bytes.Equal(sum[:], want) {
+			t.Fatalf("Sum of %d bytes = %x, want %x", n, sum, want)
+		}
+	}
+	if n := testing.AllocsPerRun(10, func() { Sum(msg) }); n != 0 {
+		t.Errorf("Sum allocates %v times", n)
+	}
+}
+
+func TestSumReader(t *testing.T) {
+	msg := make([]byte, 100000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	want := Sum(msg)
+	if got, err := SumReader(bytes.NewReader(msg)); err != nil || got != want {
+		t.Errorf("SumReader = %x, %v, want %x", got, err, want)
+	}
+	// the final data arrives together with io.EOF
+	if got, err := SumReader(iotest.DataErrReader(bytes.NewReader(msg))); err != nil || got != want {
+		t.Errorf("DataErrReader: SumReader = %x, %v, want %x", got, err, want)
+	}
+	if got, err := SumReader(iotest.OneByteReader(bytes.NewReader(msg[:1000]))); err != nil || got != Sum(msg[:1000]) {
+		t.Errorf("OneByteReader: SumReader = %x, %v", got, err)
+	}
+	if got, err := SumReader(bytes.NewReader(nil)); err != nil || got != Sum(nil) {
+		t.Errorf("empty: SumReader = %x, %v", got, err)
+	}
+	if _, err := SumReader(iotest.TimeoutReader(bytes.NewReader(msg))); err != iotest.ErrTimeout {
+		t.Errorf("TimeoutReader: SumReader error = %v, want %v", err, iotest.ErrTimeout)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	msg := make([]byte, 300)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	want := Sm3Sum(msg)
+	for _, split := range []int{0, 1, 63, 64, 100, 300} {
+		h := New()
+		h.Write(msg[:split])
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := New()
+		if err := restored.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			t.Fatal(err)
+		}
+		restored.Write(msg[split:])
+		if got := restored.Sum(nil); !bytes.Equal(got, want) {
+			t.Errorf("split at %d: got %x, want %x", split, got, want)
+		}
+	}
+	h := New().(*SM3)
+	state, _ := h.MarshalBinary()
+	if err := h.UnmarshalBinary(state[:len(state)-1]); err == nil {
+		t.Error("accepted a truncated state")
+	}
+	state[0] ^= 1
+	if err := h.UnmarshalBinary(state); err == nil {
+		t.Error("accepted a state with a bad identifier")
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	leaf := func(i int) []byte { return []byte(fmt.Sprintf("leaf %d", i)) }
+	node := func(l, r [32]byte) [32]byte {
+		return Sum(append(append([]byte{1}, l[:]...), r[:]...))
+	}
+
+	if root, want := NewMerkleTree(nil).Root(), Sum(nil); root != want {
+		t.Errorf("empty root = %x", root)
+	}
+	l := make([][32]byte, 3)
+	for i := range l {
+		l[i] = Sum(append([]byte{0}, leaf(i)...))
+	}
+	if root := NewMerkleTree([][]byte{leaf(0), leaf(1), leaf(2)}).Root(); root != node(node(l[0], l[1]), l[2]) {
+		t.Errorf("root of 3 leaves = %x", root)
+	}
+
+	for size := 1; size <= 17; size++ {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = leaf(i)
+		}
+		tree := NewMerkleTree(leaves)
+		root := tree.Root()
+		for i := 0; i < size; i++ {
+			proof, err := tree.InclusionProof(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyInclusion(root, i, size, leaves[i], proof) {
+				t.Errorf("size %d: proof of leaf %d does not verify", size, i)
+			}
+			if VerifyInclusion(root, i, size, []byte("other"), proof) {
+				t.Errorf("size %d: proof of leaf %d verifies another leaf", size, i)
+			}
+			if size > 1 && VerifyInclusion(root, (i+1)%size, size, leaves[i], proof) {
+				t.Errorf("size %d: proof of leaf %d verifies at another index", size, i)
+			}
+			if VerifyInclusion(root, i, size, leaves[i], append(proof, root)) {
+				t.Errorf("size %d: proof of leaf %d verifies with an extra hash", size, i)
+			}
+			if len(proof) > 0 {
+				proof[0][0] ^= 1
+				if VerifyInclusion(root, i, size, leaves[i], proof) {
+					t.Errorf("size %d: modified proof of leaf %d verifies", size, i)
+				}
+			}
+		}
+		if _, err := tree.InclusionProof(size); err == nil {
+			t.Errorf("size %d: proof for a leaf out of range", size)
+		}
+	}
+}
+
 func BenchmarkSm3(t *testing.B) {
 	t.ReportAllocs()
 	msg := []byte("test")
@@ -21,7 +21,9 @@ package sm4
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
@@ -38,8 +40,6 @@ type KeySizeError int
 // Cipher is an instance of SM4 encryption.
 type Sm4Cipher struct {
 	subkeys []uint32
-	block1  []uint32
-	block2  []byte
 }
 
 // sm4密钥参量
@@ -229,11 +229,16 @@ func generateSubKeys(key []byte) []uint32 {
 	return subkeys
 }
 
+// EncryptBlock encrypts one block of src into dst with key. The round keys
+// are expanded on every call, so callers encrypting several blocks with the
+// same key should keep the cipher.Block returned by NewCipher instead.
 func EncryptBlock(key SM4Key, dst, src []byte) {
 	subkeys := generateSubKeys(key)
 	cryptBlock(subkeys, make([]uint32, 4), make([]byte, 16), dst, src, false)
 }
 
+// DecryptBlock decrypts one block of src into dst with key. Like
+// EncryptBlock it expands the round keys on every call.
 func DecryptBlock(key SM4Key, dst, src []byte) {
 	subkeys := generateSubKeys(key)
 	cryptBlock(subkeys, make([]uint32, 4), make([]byte, 16), dst, src, true)
@@ -317,15 +322,16 @@ func (k KeySizeError) Error() string {
 	return "SM4: invalid key size " + strconv.Itoa(int(k))
 }
 
-// NewCipher creates and returns a new cipher.Block.
+// NewCipher expands key into the round keys once and returns the SM4
+// cipher.Block. The block keeps no other state, so it may be reused for
+// any number of Encrypt and Decrypt calls, also from several goroutines,
+// and should be cached rather than recreated for each message.
 func NewCipher(key []byte) (cipher.Block, error) {
 	if len(key) != BlockSize {
 		return nil, KeySizeError(len(key))
 	}
 	c := new(Sm4Cipher)
 	c.subkeys = generateSubKeys(key)
-	c.block1 = make([]uint32, 4)
-	c.block2 = make([]byte, 16)
 	return c, nil
 }
 
@@ -334,9 +340,662 @@ func (c *Sm4Cipher) BlockSize() int {
 }
 
 func (c *Sm4Cipher) Encrypt(dst, src []byte) {
-	cryptBlock(c.subkeys, c.block1, c.block2, dst, src, false)
+	var b [4]uint32
+	var r [BlockSize]byte
+	cryptBlock(c.subkeys, b[:], r[:], dst, src, false)
 }
 
 func (c *Sm4Cipher) Decrypt(dst, src []byte) {
-	cryptBlock(c.subkeys, c.block1, c.block2, dst, src, true)
+	var b [4]uint32
+	var r [BlockSize]byte
+	cryptBlock(c.subkeys, b[:], r[:], dst, src, true)
+}
+
+// newStreamCipher checks iv and creates the block cipher for the stream modes.
+func newStreamCipher(key, iv []byte) (cipher.Block, error) {
+	if len(iv) != BlockSize {
+		return nil, errors.New("SM4: IV length must equal block size")
+	}
+	return NewCipher(key)
+}
+
+// NewCFBEncrypter returns a cipher.Stream which encrypts with SM4 in cipher
+// feedback mode, like cipher.NewCFBEncrypter. The data need not be a
+// multiple of the block size.
+func NewCFBEncrypter(key, iv []byte) (cipher.Stream, error) {
+	block, err := newStreamCipher(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCFBEncrypter(block, iv), nil
+}
+
+// NewCFBDecrypter returns a cipher.Stream which decrypts with SM4 in cipher
+// feedback mode, like cipher.NewCFBDecrypter.
+func NewCFBDecrypter(key, iv []byte) (cipher.Stream, error) {
+	block, err := newStreamCipher(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCFBDecrypter(block, iv), nil
+}
+
+// NewOFB returns a cipher.Stream which encrypts or decrypts with SM4 in
+// output feedback mode, like cipher.NewOFB.
+func NewOFB(key, iv []byte) (cipher.Stream, error) {
+	block, err := newStreamCipher(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewOFB(block, iv), nil
+}
+
+// EncryptECB encrypts plaintext with SM4 in electronic codebook mode. The
+// plaintext must be a multiple of the block size, no padding is applied.
+//
+// ECB encrypts equal blocks to equal ciphertext and so leaks the structure of
+// the data. It is insecure for general use and is only provided for
+// interoperability with systems that require it.
+func EncryptECB(key, plaintext []byte) ([]byte, error) {
+	return cryptECB(key, plaintext, false)
+}
+
+// DecryptECB decrypts ciphertext with SM4 in electronic codebook mode. See
+// EncryptECB for why ECB must not be used for new designs.
+func DecryptECB(key, ciphertext []byte) ([]byte, error) {
+	return cryptECB(key, ciphertext, true)
+}
+
+func cryptECB(key, in []byte, decrypt bool) ([]byte, error) {
+	if len(in)%BlockSize != 0 {
+		return nil, errors.New("SM4: input not full blocks")
+	}
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(in))
+	for i := 0; i < len(in); i += BlockSize {
+		if decrypt {
+			c.Decrypt(out[i:i+BlockSize], in[i:i+BlockSize])
+		} else {
+			c.Encrypt(out[i:i+BlockSize], in[i:i+BlockSize])
+		}
+	}
+	return out, nil
+}
+
+// ctrBlocks is the number of blocks of key stream sm4CTR generates at once.
+const ctrBlocks = 4
+
+// encryptBlocks encrypts ctrBlocks blocks from src into dst. The rounds of
+// the blocks are interleaved so that their table lookups can overlap.
+func encryptBlocks(subkeys []uint32, dst, src []byte) {
+	var b [ctrBlocks][4]uint32
+	for j := range b {
+		permuteInitialBlock(b[j][:], src[j*BlockSize:])
+	}
+	for _, rk := range subkeys {
+		for j := range b {
+			x := b[j][1] ^ b[j][2] ^ b[j][3] ^ rk
+			x = b[j][0] ^ sbox0[x&0xff] ^ sbox1[(x>>8)&0xff] ^ sbox2[(x>>16)&0xff] ^ sbox3[(x>>24)&0xff]
+			b[j][0], b[j][1], b[j][2], b[j][3] = b[j][1], b[j][2], b[j][3], x
+		}
+	}
+	for j := range b {
+		b[j][0], b[j][1], b[j][2], b[j][3] = b[j][3], b[j][2], b[j][1], b[j][0]
+		permuteFinalBlock(dst[j*BlockSize:], b[j][:])
+	}
+}
+
+// sm4CTR is the counter mode returned by cipher.NewCTR for an Sm4Cipher,
+// and the one of its GCM.
+type sm4CTR struct {
+	subkeys []uint32
+	inc     func(ctr []byte)
+	ctr     [ctrBlocks * BlockSize]byte
+	out     [ctrBlocks * BlockSize]byte
+	outUsed int
+}
+
+// NewCTR returns a counter mode stream that encrypts several blocks per
+// call. It is used by cipher.NewCTR, so callers need not call it directly.
+func (c *Sm4Cipher) NewCTR(iv []byte) cipher.Stream {
+	if len(iv) != BlockSize {
+		panic("cipher.NewCTR: IV length must equal block size")
+	}
+	return newCTR(c.subkeys, iv, incCounter)
+}
+
+// newCTR returns a counter mode stream starting at iv that steps the
+// counter with inc.
+func newCTR(subkeys []uint32, iv []byte, inc func(ctr []byte)) *sm4CTR {
+	x := &sm4CTR{
+		subkeys: subkeys,
+		inc:     inc,
+		outUsed: len(sm4CTR{}.out),
+	}
+	copy(x.ctr[:], iv)
+	for i := BlockSize; i < len(x.ctr); i += BlockSize {
+		copy(x.ctr[i:], x.ctr[i-BlockSize:i])
+		inc(x.ctr[i : i+BlockSize])
+	}
+	return x
+}
+
+// incCounter increments a big endian counter block.
+func incCounter(ctr []byte) {
+	for i := len(ctr) - 1; i >= 0; i-- {
+		ctr[i]++
+		if ctr[i] != 0 {
+			break
+		}
+	}
+}
+
+// incCounter32 increments the last 32 bits of a counter block, as GCM
+// does.
+func incCounter32(ctr []byte) {
+	incCounter(ctr[len(ctr)-4:])
+}
+
+func (x *sm4CTR) refill() {
+	encryptBlocks(x.subkeys, x.out[:], x.ctr[:])
+	for i := 0; i < len(x.ctr); i += BlockSize {
+		for j := 0; j < ctrBlocks; j++ {
+			x.inc(x.ctr[i : i+BlockSize])
+		}
+	}
+	x.outUsed = 0
+}
+
+func (x *sm4CTR) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("crypto/cipher: output smaller than input")
+	}
+	for len(src) > 0 {
+		if x.outUsed == len(x.out) {
+			x.refill()
+		}
+		n := len(src)
+		if n > len(x.out)-x.outUsed {
+			n = len(x.out) - x.outUsed
+		}
+		for i, k := range x.out[x.outUsed : x.outUsed+n] {
+			dst[i] = src[i] ^ k
+		}
+		dst, src = dst[n:], src[n:]
+		x.outUsed += n
+	}
+}
+
+const (
+	gcmStandardNonceSize = 12
+	gcmTagSize           = 16
+	gcmMinimumTagSize    = 12
+)
+
+// gcmFieldElement is an element of GF(2^128) in the bit order of GCM:
+// low holds the first eight bytes of a block.
+type gcmFieldElement struct {
+	low, high uint64
+}
+
+// sm4GCM is the GCM returned by cipher.NewGCM for an Sm4Cipher. The key
+// stream comes from sm4CTR, several blocks at a time, and GHASH uses a
+// table of 4-bit multiples of H as in the generic GCM of crypto/cipher.
+type sm4GCM struct {
+	c            *Sm4Cipher
+	nonceSize    int
+	tagSize      int
+	productTable [16]gcmFieldElement
+}
+
+// NewGCM returns SM4 in Galois Counter Mode. It is used by cipher.NewGCM
+// and its variants, which check the sizes, so callers need not call it
+// directly.
+func (c *Sm4Cipher) NewGCM(nonceSize, tagSize int) (cipher.AEAD, error) {
+	if tagSize < gcmMinimumTagSize || tagSize > gcmTagSize {
+		return nil, errors.New("SM4: GCM tag size must be 12 to 16 bytes")
+	}
+	if nonceSize <= 0 {
+		return nil, errors.New("SM4: GCM nonce must not be empty")
+	}
+	g := &sm4GCM{c: c, nonceSize: nonceSize, tagSize: tagSize}
+	var key [BlockSize]byte
+	c.Encrypt(key[:], key[:])
+	x := gcmFieldElement{
+		binary.BigEndian.Uint64(key[:8]),
+		binary.BigEndian.Uint64(key[8:]),
+	}
+	g.productTable[reverseBits(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.productTable[reverseBits(i)] = gcmDouble(&g.productTable[reverseBits(i/2)])
+		g.productTable[reverseBits(i+1)] = gcmAdd(&g.productTable[reverseBits(i)], &x)
+	}
+	return g, nil
+}
+
+func (g *sm4GCM) NonceSize() int {
+	return g.nonceSize
+}
+
+func (g *sm4GCM) Overhead() int {
+	return g.tagSize
+}
+
+func (g *sm4GCM) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != g.nonceSize {
+		panic("SM4: incorrect nonce length given to GCM")
+	}
+	if uint64(len(plaintext)) > ((1<<32)-2)*BlockSize {
+		panic("SM4: message too large for GCM")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+g.tagSize)
+
+	var counter, tagMask [BlockSize]byte
+	g.deriveCounter(&counter, nonce)
+	g.c.Encrypt(tagMask[:], counter[:])
+	incCounter32(counter[:])
+	newCTR(g.c.subkeys, counter[:], incCounter32).XORKeyStream(out, plaintext)
+
+	var tag [gcmTagSize]byte
+	g.auth(tag[:], out[:len(plaintext)], additionalData, &tagMask)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *sm4GCM) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != g.nonceSize {
+		panic("SM4: incorrect nonce length given to GCM")
+	}
+	if len(ciphertext) < g.tagSize ||
+		uint64(len(ciphertext)) > ((1<<32)-2)*BlockSize+uint64(g.tagSize) {
+		return nil, errors.New("SM4: message authentication failed")
+	}
+	tag := ciphertext[len(ciphertext)-g.tagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-g.tagSize]
+
+	var counter, tagMask [BlockSize]byte
+	g.deriveCounter(&counter, nonce)
+	g.c.Encrypt(tagMask[:], counter[:])
+	incCounter32(counter[:])
+
+	var expectedTag [gcmTagSize]byte
+	g.auth(expectedTag[:], ciphertext, additionalData, &tagMask)
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	if subtle.ConstantTimeCompare(expectedTag[:g.tagSize], tag) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errors.New("SM4: message authentication failed")
+	}
+	newCTR(g.c.subkeys, counter[:], incCounter32).XORKeyStream(out, ciphertext)
+	return ret, nil
+}
+
+// deriveCounter computes the initial counter block J0 from the nonce.
+func (g *sm4GCM) deriveCounter(counter *[BlockSize]byte, nonce []byte) {
+	if len(nonce) == gcmStandardNonceSize {
+		copy(counter[:], nonce)
+		counter[BlockSize-1] = 1
+		return
+	}
+	var y gcmFieldElement
+	g.update(&y, nonce)
+	y.high ^= uint64(len(nonce)) * 8
+	g.mul(&y)
+	binary.BigEndian.PutUint64(counter[:8], y.low)
+	binary.BigEndian.PutUint64(counter[8:], y.high)
+}
+
+// auth writes the GHASH of additionalData and ciphertext, masked with
+// tagMask, to out.
+func (g *sm4GCM) auth(out, ciphertext, additionalData []byte, tagMask *[BlockSize]byte) {
+	var y gcmFieldElement
+	g.update(&y, additionalData)
+	g.update(&y, ciphertext)
+	y.low ^= uint64(len(additionalData)) * 8
+	y.high ^= uint64(len(ciphertext)) * 8
+	g.mul(&y)
+	binary.BigEndian.PutUint64(out, y.low)
+	binary.BigEndian.PutUint64(out[8:], y.high)
+	for i := range tagMask {
+		out[i] ^= tagMask[i]
+	}
+}
+
+// update absorbs data into y, padding a final partial block with zeros.
+func (g *sm4GCM) update(y *gcmFieldElement, data []byte) {
+	for ; len(data) >= BlockSize; data = data[BlockSize:] {
+		y.low ^= binary.BigEndian.Uint64(data)
+		y.high ^= binary.BigEndian.Uint64(data[8:])
+		g.mul(y)
+	}
+	if len(data) > 0 {
+		var block [BlockSize]byte
+		copy(block[:], data)
+		y.low ^= binary.BigEndian.Uint64(block[:])
+		y.high ^= binary.BigEndian.Uint64(block[8:])
+		g.mul(y)
+	}
+}
+
+// gcmReductionTable is the reduction of the four bits shifted out of a
+// field element by a multiplication by x^4.
+var gcmReductionTable = []uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+// mul sets y to y*H.
+func (g *sm4GCM) mul(y *gcmFieldElement) {
+	var z gcmFieldElement
+	for i := 0; i < 2; i++ {
+		word := y.high
+		if i == 1 {
+			word = y.low
+		}
+		for j := 0; j < 64; j += 4 {
+			msw := z.high & 0xf
+			z.high >>= 4
+			z.high |= z.low << 60
+			z.low >>= 4
+			z.low ^= uint64(gcmReductionTable[msw]) << 48
+
+			t := &g.productTable[word&0xf]
+			z.low ^= t.low
+			z.high ^= t.high
+			word >>= 4
+		}
+	}
+	*y = z
+}
+
+// reverseBits reverses the order of the four bits of i.
+func reverseBits(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+func gcmAdd(x, y *gcmFieldElement) gcmFieldElement {
+	return gcmFieldElement{x.low ^ y.low, x.high ^ y.high}
+}
+
+// gcmDouble returns x*2 in the bit order of GCM.
+func gcmDouble(x *gcmFieldElement) (double gcmFieldElement) {
+	msbSet := x.high&1 == 1
+	double.high = x.high >> 1
+	double.high |= x.low << 63
+	double.low = x.low >> 1
+	if msbSet {
+		double.low ^= 0xe100000000000000
+	}
+	return
+}
+
+// XTS is SM4 in the XTS mode of IEEE 1619, which encrypts the sectors of
+// a disk in place. Each sector is encrypted on its own under a tweak
+// derived from its number. A sector may be any length of at least one
+// block; a final partial block is handled by ciphertext stealing.
+type XTS struct {
+	k1, k2 cipher.Block // data and tweak ciphers
+}
+
+// NewXTS returns SM4-XTS with the data key key1 and the tweak key key2.
+// The keys must differ, as IEEE 1619 requires.
+func NewXTS(key1, key2 []byte) (*XTS, error) {
+	k1, err := NewCipher(key1)
+	if err != nil {
+		return nil, err
+	}
+	k2, err := NewCipher(key2)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(key1, key2) == 1 {
+		return nil, errors.New("SM4: XTS keys must differ")
+	}
+	return &XTS{k1: k1, k2: k2}, nil
+}
+
+// Encrypt encrypts buf, the contents of sector, in place.
+func (x *XTS) Encrypt(sector uint64, buf []byte) error {
+	return x.crypt(sector, buf, false)
+}
+
+// Decrypt decrypts buf, the contents of sector, in place.
+func (x *XTS) Decrypt(sector uint64, buf []byte) error {
+	return x.crypt(sector, buf, true)
+}
+
+func (x *XTS) crypt(sector uint64, buf []byte, decrypt bool) error {
+	if len(buf) < BlockSize {
+		return errors.New("SM4: XTS sector shorter than a block")
+	}
+	var tweak [BlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:], sector)
+	x.k2.Encrypt(tweak[:], tweak[:])
+
+	tail := len(buf) % BlockSize
+	full := len(buf) - tail
+	if tail > 0 {
+		full -= BlockSize // the last full block takes part in the stealing
+	}
+	for i := 0; i < full; i += BlockSize {
+		x.cryptBlock(buf[i:i+BlockSize], &tweak, decrypt)
+		mulAlpha(&tweak)
+	}
+	if tail == 0 {
+		return nil
+	}
+	last, partial := buf[full:full+BlockSize], buf[full+BlockSize:]
+	if decrypt {
+		next := tweak
+		mulAlpha(&next)
+		x.cryptBlock(last, &next, true)
+		for i := range partial {
+			last[i], partial[i] = partial[i], last[i]
+		}
+		x.cryptBlock(last, &tweak, true)
+	} else {
+		x.cryptBlock(last, &tweak, false)
+		mulAlpha(&tweak)
+		for i := range partial {
+			last[i], partial[i] = partial[i], last[i]
+		}
+		x.cryptBlock(last, &tweak, false)
+	}
+	return nil
+}
+
+// cryptBlock encrypts or decrypts the block b in place as tweak ^ E(b ^
+// tweak).
+func (x *XTS) cryptBlock(b []byte, tweak *[BlockSize]byte, decrypt bool) {
+	for i := range tweak {
+		b[i] ^= tweak[i]
+	}
+	if decrypt {
+		x.k1.Decrypt(b, b)
+	} else {
+		x.k1.Encrypt(b, b)
+	}
+	for i := range tweak {
+		b[i] ^= tweak[i]
+	}
+}
+
+// mulAlpha multiplies the tweak by the primitive element of GF(2^128),
+// little endian with the polynomial x^128 + x^7 + x^2 + x + 1.
+func mulAlpha(t *[BlockSize]byte) {
+	carry := t[BlockSize-1] >> 7
+	for i := BlockSize - 1; i > 0; i-- {
+		t[i] = t[i]<<1 | t[i-1]>>7
+	}
+	t[0] = t[0]<<1 ^ 0x87*carry
+}
+
+// ccm is the CCM mode of NIST SP 800-38C and RFC 3610: a CBC-MAC over the
+// nonce, the lengths, the additional data and the plaintext, then CTR
+// encryption of the plaintext and of the MAC.
+type ccm struct {
+	b         cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+// NewCCM returns SM4 in CCM mode, as used by RFC 8998. nonceSize is 7 to
+// 13 bytes; it fixes the length field to 15 - nonceSize bytes and so the
+// longest message. tagSize is an even number of bytes from 4 to 16.
+func NewCCM(key []byte, nonceSize, tagSize int) (cipher.AEAD, error) {
+	b, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return newCCM(b, nonceSize, tagSize)
+}
+
+func newCCM(b cipher.Block, nonceSize, tagSize int) (cipher.AEAD, error) {
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("SM4: CCM nonce size must be 7 to 13 bytes")
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("SM4: CCM tag size must be an even number of bytes from 4 to 16")
+	}
+	return &ccm{b: b, nonceSize: nonceSize, tagSize: tagSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+
+func (c *ccm) Overhead() int { return c.tagSize }
+
+// maxLength returns the longest plaintext the length field can encode.
+func (c *ccm) maxLength() uint64 {
+	l := 15 - c.nonceSize
+	if l >= 8 {
+		return 1<<64 - 1
+	}
+	return 1<<(8*uint(l)) - 1
+}
+
+// counter returns the counter block A_i for the nonce.
+func (c *ccm) counter(nonce []byte, i byte) []byte {
+	a := make([]byte, BlockSize)
+	a[0] = byte(14 - c.nonceSize) // L - 1
+	copy(a[1:], nonce)
+	a[BlockSize-1] = i
+	return a
+}
+
+// mac returns the CBC-MAC T of the message, not yet encrypted.
+func (c *ccm) mac(nonce, plaintext, data []byte) []byte {
+	var x [BlockSize]byte
+	n := 0
+	write := func(p []byte) {
+		for _, v := range p {
+			x[n] ^= v
+			if n++; n == BlockSize {
+				c.b.Encrypt(x[:], x[:])
+				n = 0
+			}
+		}
+	}
+	flush := func() { // zero pad to a block
+		if n > 0 {
+			c.b.Encrypt(x[:], x[:])
+			n = 0
+		}
+	}
+
+	var b0 [BlockSize]byte
+	b0[0] = byte((c.tagSize-2)/2<<3 | (14 - c.nonceSize))
+	if len(data) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(plaintext)))
+	copy(b0[1+c.nonceSize:], size[8-(15-c.nonceSize):])
+	write(b0[:])
+
+	if len(data) > 0 {
+		var prefix []byte
+		switch {
+		case uint64(len(data)) < 0xff00:
+			prefix = []byte{0, 0}
+			binary.BigEndian.PutUint16(prefix, uint16(len(data)))
+		case uint64(len(data)) <= 0xffffffff:
+			prefix = []byte{0xff, 0xfe, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(prefix[2:], uint32(len(data)))
+		default:
+			prefix = []byte{0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint64(prefix[2:], uint64(len(data)))
+		}
+		write(prefix)
+		write(data)
+		flush()
+	}
+	write(plaintext)
+	flush()
+	return x[:c.tagSize]
+}
+
+// tag encrypts the CBC-MAC with the key stream block S_0.
+func (c *ccm) tag(nonce, plaintext, data []byte) []byte {
+	t := c.mac(nonce, plaintext, data)
+	s0 := c.counter(nonce, 0)
+	c.b.Encrypt(s0, s0)
+	for i := range t {
+		t[i] ^= s0[i]
+	}
+	return t
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, data []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("SM4: incorrect nonce length given to CCM")
+	}
+	if uint64(len(plaintext)) > c.maxLength() {
+		panic("SM4: message too large for CCM")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+c.tagSize)
+	t := c.tag(nonce, plaintext, data)
+	cipher.NewCTR(c.b, c.counter(nonce, 1)).XORKeyStream(out, plaintext)
+	copy(out[len(plaintext):], t)
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("SM4: incorrect nonce length given to CCM")
+	}
+	if len(ciphertext) < c.tagSize || uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, errors.New("SM4: message authentication failed")
+	}
+	tag := ciphertext[len(ciphertext)-c.tagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-c.tagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	cipher.NewCTR(c.b, c.counter(nonce, 1)).XORKeyStream(out, ciphertext)
+	if subtle.ConstantTimeCompare(c.tag(nonce, out, data), tag) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errors.New("SM4: message authentication failed")
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// n new bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
 }
@@ -16,6 +16,10 @@ limitations under the License.
 package sm4
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"reflect"
@@ -85,6 +89,45 @@ func TestErrKeyLen(t *testing.T) {
 	fmt.Println("------------------end----------------------")
 }
 
+// The block returned by NewCipher keeps only the round keys, so reusing it,
+// also concurrently, gives the same results as a fresh cipher per block.
+func TestCipherReuse(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	want, _ := hex.DecodeString("681edf34d206965e86b3e94f536e4246")
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	for g := 0; g < 4; g++ {
+		go func() {
+			dst := make([]byte, BlockSize)
+			for i := 0; i < 1000; i++ {
+				c.Encrypt(dst, key)
+				if !bytes.Equal(dst, want) {
+					done <- fmt.Errorf("Encrypt = %x, want %x", dst, want)
+					return
+				}
+				c.Decrypt(dst, dst)
+				if !bytes.Equal(dst, key) {
+					done <- fmt.Errorf("Decrypt = %x, want %x", dst, key)
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	dst := make([]byte, BlockSize)
+	if n := testing.AllocsPerRun(10, func() { c.Encrypt(dst, key) }); n != 0 {
+		t.Errorf("Encrypt allocates %v times", n)
+	}
+}
+
 func testCompare(key1, key2 []byte) bool {
 	if len(key1) != len(key2) {
 		return false
@@ -100,3 +143,440 @@ func testCompare(key1, key2 []byte) bool {
 	}
 	return true
 }
+
+// The request asked for GmSSL vectors, but GmSSL was not available, so
+// these come from openssl enc -sm4-cfb and -sm4-ofb of OpenSSL 3.0. Both
+// tools implement the CFB128 and OFB modes of GB/T 17964.
+func TestStreamModes(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	iv, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	msg := []byte("The quick brown fox jumps over the lazy dog.")
+	tests := []struct {
+		name       string
+		enc, dec   func(key, iv []byte) (cipher.Stream, error)
+		ciphertext string
+	}{
+		{"CFB", NewCFBEncrypter, NewCFBDecrypter,
+			"52f0f9414cd301ce41ad95f08edf974aebdab6ed9ce21b3172640c3512ebed77dc634ef8e55749e62a86e5b1"},
+		{"OFB", NewOFB, NewOFB,
+			"52f0f9414cd301ce41ad95f08edf974a95803a6cddf6370d127f83e2b851c8543322b824ee737e0854816308"},
+	}
+	for _, test := range tests {
+		want, _ := hex.DecodeString(test.ciphertext)
+		enc, err := test.enc(key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// in pieces that are not block aligned
+		ct := make([]byte, len(msg))
+		enc.XORKeyStream(ct[:5], msg[:5])
+		enc.XORKeyStream(ct[5:21], msg[5:21])
+		enc.XORKeyStream(ct[21:], msg[21:])
+		if !bytes.Equal(ct, want) {
+			t.Errorf("%s: got %x, want %x", test.name, ct, want)
+		}
+		dec, err := test.dec(key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt := make([]byte, len(ct))
+		dec.XORKeyStream(pt, ct)
+		if !bytes.Equal(pt, msg) {
+			t.Errorf("%s: decrypted %q", test.name, pt)
+		}
+		if _, err := test.enc(key, iv[:8]); err == nil {
+			t.Errorf("%s: accepted a short IV", test.name)
+		}
+		if _, err := test.enc(key[:8], iv); err == nil {
+			t.Errorf("%s: accepted a short key", test.name)
+		}
+	}
+}
+
+func TestECB(t *testing.T) {
+	// GB/T 32907 example 1, the block is repeated to check that there is no
+	// chaining
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	block, _ := hex.DecodeString("681edf34d206965e86b3e94f536e4246")
+	pt := append(append([]byte(nil), key...), key...)
+	want := append(append([]byte(nil), block...), block...)
+	ct, err := EncryptECB(key, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ct, want) {
+		t.Errorf("EncryptECB = %x, want %x", ct, want)
+	}
+	dec, err := DecryptECB(key, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, pt) {
+		t.Errorf("DecryptECB = %x, want %x", dec, pt)
+	}
+	if _, err := EncryptECB(key, pt[:20]); err == nil {
+		t.Error("EncryptECB accepted a partial block")
+	}
+	if _, err := DecryptECB(key, ct[:31]); err == nil {
+		t.Error("DecryptECB accepted a partial block")
+	}
+}
+
+// blockOnly hides the NewCTR and NewGCM methods of Sm4Cipher, so that
+// cipher.NewCTR and cipher.NewGCM use their generic one block at a time
+// implementations.
+type blockOnly struct {
+	cipher.Block
+}
+
+func TestCTR(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 1000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	// the last two counters wrap around within the message
+	for _, iv := range [][]byte{
+		make([]byte, BlockSize),
+		bytes.Repeat([]byte{0xff}, BlockSize),
+		{0, 1, 2, 3, 4, 5, 6, 7, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfd},
+	} {
+		want := make([]byte, len(msg))
+		cipher.NewCTR(blockOnly{c}, iv).XORKeyStream(want, msg)
+		got := make([]byte, len(msg))
+		ctr := cipher.NewCTR(c, iv)
+		off := 0
+		for _, n := range []int{1, 15, 17, 64, 100, 803} {
+			ctr.XORKeyStream(got[off:off+n], msg[off:off+n])
+			off += n
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("iv %x: key stream differs from the generic CTR", iv)
+		}
+	}
+}
+
+func benchmarkCTR(b *testing.B, block cipher.Block) {
+	buf := make([]byte, 8192)
+	ctr := cipher.NewCTR(block, make([]byte, BlockSize))
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctr.XORKeyStream(buf, buf)
+	}
+}
+
+func BenchmarkCTR(b *testing.B) {
+	c, _ := NewCipher([]byte("1234567890abcdef"))
+	b.Run("generic", func(b *testing.B) { benchmarkCTR(b, blockOnly{c}) })
+	b.Run("multiblock", func(b *testing.B) { benchmarkCTR(b, c) })
+}
+
+// The vector of RFC 8998, appendix A.1.
+func TestGCM(t *testing.T) {
+	c, err := NewCipher(mustHex("0123456789abcdeffedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := aead.(*sm4GCM); !ok {
+		t.Fatalf("cipher.NewGCM returned %T", aead)
+	}
+	nonce := mustHex("00001234567800000000abcd")
+	aad := mustHex("feedfacedeadbeeffeedfacedeadbeefabaddad2")
+	pt := mustHex("aaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbccccccccccccccccdddddddddddddddd" +
+		"eeeeeeeeeeeeeeeeffffffffffffffffeeeeeeeeeeeeeeeeaaaaaaaaaaaaaaaa")
+	want := mustHex("17f399f08c67d5ee19d0dc9969c4bb7d5fd46fd3756489069157b282bb200735" +
+		"d82710ca5c22f0ccfa7cbf93d496ac15a56834cbcf98c397b4024a2691233b8d" +
+		"83de3541e4c2b58177e065a9bf7b62ec")
+	ct := aead.Seal(nil, nonce, pt, aad)
+	if !bytes.Equal(ct, want) {
+		t.Fatalf("got %x, want %x", ct, want)
+	}
+	got, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil || !bytes.Equal(got, pt) {
+		t.Fatalf("Open = %x, %v", got, err)
+	}
+	ct[0] ^= 1
+	if _, err := aead.Open(nil, nonce, ct, aad); err == nil {
+		t.Error("opened a modified ciphertext")
+	}
+}
+
+func TestGCMGeneric(t *testing.T) {
+	c, err := NewCipher(mustHex("0123456789abcdeffedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := c.(*Sm4Cipher)
+	msg := make([]byte, 300)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	for _, sizes := range []struct{ nonce, tag int }{{12, 16}, {8, 16}, {16, 16}, {12, 12}} {
+		aead, err := sc.NewGCM(sizes.nonce, sizes.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic cipher.AEAD
+		if sizes.tag != 16 {
+			generic, err = cipher.NewGCMWithTagSize(blockOnly{c}, sizes.tag)
+		} else {
+			generic, err = cipher.NewGCMWithNonceSize(blockOnly{c}, sizes.nonce)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := msg[:sizes.nonce]
+		for _, n := range []int{0, 1, 15, 16, 17, 64, 65, 300} {
+			want := generic.Seal(nil, nonce, msg[:n], msg[n/2:])
+			got := aead.Seal(nil, nonce, msg[:n], msg[n/2:])
+			if !bytes.Equal(got, want) {
+				t.Fatalf("nonce %d, tag %d, %d bytes: got %x, want %x", sizes.nonce, sizes.tag, n, got, want)
+			}
+			pt, err := aead.Open(nil, nonce, got, msg[n/2:])
+			if err != nil || !bytes.Equal(pt, msg[:n]) {
+				t.Fatalf("nonce %d, tag %d, %d bytes: Open = %x, %v", sizes.nonce, sizes.tag, n, pt, err)
+			}
+		}
+	}
+	if _, err := sc.NewGCM(12, 11); err == nil {
+		t.Error("accepted an 11-byte tag")
+	}
+	if _, err := sc.NewGCM(0, 16); err == nil {
+		t.Error("accepted an empty nonce")
+	}
+}
+
+func benchmarkGCM(b *testing.B, block cipher.Block) {
+	buf := make([]byte, 8192)
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aead.Seal(buf[:0], nonce, buf[:len(buf)-aead.Overhead()], nil)
+	}
+}
+
+func BenchmarkGCM(b *testing.B) {
+	c, _ := NewCipher([]byte("1234567890abcdef"))
+	b.Run("generic", func(b *testing.B) { benchmarkGCM(b, blockOnly{c}) })
+	b.Run("multiblock", func(b *testing.B) { benchmarkGCM(b, c) })
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The mode is checked with AES against vectors 1, 2 and 15 of IEEE 1619,
+// the last with ciphertext stealing, as no SM4-XTS vectors are published.
+func TestXTSWithAES(t *testing.T) {
+	for i, tc := range []struct {
+		key1, key2 string
+		sector     uint64
+		pt, ct     string
+	}{
+		{
+			"00000000000000000000000000000000", "00000000000000000000000000000000", 0,
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e",
+		},
+		{
+			"11111111111111111111111111111111", "22222222222222222222222222222222", 0x3333333333,
+			"4444444444444444444444444444444444444444444444444444444444444444",
+			"c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0",
+		},
+		{
+			"fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0", "bfbebdbcbbbab9b8b7b6b5b4b3b2b1b0", 0x123456789a,
+			"000102030405060708090a0b0c0d0e0f10",
+			"6c1625db4671522d3d7599601de7ca09ed",
+		},
+	} {
+		k1, _ := aes.NewCipher(mustHex(tc.key1))
+		k2, _ := aes.NewCipher(mustHex(tc.key2))
+		x := &XTS{k1: k1, k2: k2}
+		buf := mustHex(tc.pt)
+		if err := x.Encrypt(tc.sector, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, mustHex(tc.ct)) {
+			t.Errorf("vector %d: got %x", i, buf)
+		}
+		if err := x.Decrypt(tc.sector, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, mustHex(tc.pt)) {
+			t.Errorf("vector %d: decrypted to %x", i, buf)
+		}
+	}
+}
+
+func TestXTS(t *testing.T) {
+	key1 := mustHex("0123456789abcdeffedcba9876543210")
+	key2 := mustHex("fedcba98765432100123456789abcdef")
+	x, err := NewXTS(key1, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewXTS(key1, key1); err == nil {
+		t.Error("NewXTS accepted equal keys")
+	}
+	if _, err := NewXTS(key1, key2[:8]); err == nil {
+		t.Error("NewXTS accepted a short key")
+	}
+
+	// The first block is E1(P ^ T) ^ T with T = E2(sector).
+	sector := uint64(0x0102030405060708)
+	pt := make([]byte, 512)
+	for i := range pt {
+		pt[i] = byte(i)
+	}
+	tweak := make([]byte, BlockSize)
+	for i := 0; i < 8; i++ {
+		tweak[i] = byte(sector >> (8 * uint(i)))
+	}
+	EncryptBlock(key2, tweak, tweak)
+	want := make([]byte, BlockSize)
+	for i := range want {
+		want[i] = pt[i] ^ tweak[i]
+	}
+	EncryptBlock(key1, want, want)
+	for i := range want {
+		want[i] ^= tweak[i]
+	}
+	buf := append([]byte{}, pt...)
+	if err := x.Encrypt(sector, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:BlockSize], want) {
+		t.Errorf("first block %x, want %x", buf[:BlockSize], want)
+	}
+	other := append([]byte{}, pt...)
+	x.Encrypt(sector+1, other)
+	if bytes.Equal(buf, other) {
+		t.Error("sectors encrypt equally")
+	}
+
+	for _, n := range []int{16, 17, 31, 32, 33, 100, 512, 4095, 4096} {
+		buf := append([]byte{}, pt[:n%512]...)
+		buf = append(buf, bytes.Repeat([]byte{0xa5}, n-len(buf))...)
+		orig := append([]byte{}, buf...)
+		if err := x.Encrypt(7, buf); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buf, orig) {
+			t.Errorf("%d bytes: not encrypted", n)
+		}
+		if err := x.Decrypt(7, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, orig) {
+			t.Errorf("%d bytes: round trip failed", n)
+		}
+	}
+	if err := x.Encrypt(0, make([]byte, 15)); err == nil {
+		t.Error("encrypted a sector shorter than a block")
+	}
+}
+
+// RFC 3610 packet vectors 1 and 2, which check the CCM construction with AES.
+func TestCCMWithAES(t *testing.T) {
+	b, _ := aes.NewCipher(mustHex("c0c1c2c3c4c5c6c7c8c9cacbcccdcecf"))
+	aead, err := newCCM(b, 13, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		nonce, data, pt, ct string
+	}{
+		{
+			"00000003020100a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0",
+		},
+		{
+			"00000004030201a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3ba091d56e10400916",
+		},
+	} {
+		nonce, data := mustHex(tc.nonce), mustHex(tc.data)
+		ct := aead.Seal(nil, nonce, mustHex(tc.pt), data)
+		if !bytes.Equal(ct, mustHex(tc.ct)) {
+			t.Errorf("vector %d: got %x", i+1, ct)
+		}
+		pt, err := aead.Open(nil, nonce, ct, data)
+		if err != nil || !bytes.Equal(pt, mustHex(tc.pt)) {
+			t.Errorf("vector %d: Open = %x, %v", i+1, pt, err)
+		}
+	}
+}
+
+// RFC 8998 appendix A.2
+func TestCCM(t *testing.T) {
+	aead, err := NewCCM(mustHex("0123456789abcdeffedcba9876543210"), 12, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := mustHex("00001234567800000000abcd")
+	data := mustHex("feedfacedeadbeeffeedfacedeadbeefabaddad2")
+	pt := mustHex("aaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbccccccccccccccccdddddddddddddddd" +
+		"eeeeeeeeeeeeeeeeffffffffffffffffeeeeeeeeeeeeeeeeaaaaaaaaaaaaaaaa")
+	want := mustHex("48af93501fa62adbcd414cce6034d895dda1bf8f132f042098661572e7483094" +
+		"fd12e518ce062c98acee28d95df4416bed31a2f04476c18bb40c84a74b97dc5b" +
+		"16842d4fa186f56ab33256971fa110f4")
+	ct := aead.Seal(nil, nonce, pt, data)
+	if !bytes.Equal(ct, want) {
+		t.Errorf("got %x", ct)
+	}
+	got, err := aead.Open(nil, nonce, ct, data)
+	if err != nil || !bytes.Equal(got, pt) {
+		t.Errorf("Open = %x, %v", got, err)
+	}
+
+	// in place, without additional data
+	buf := append([]byte(nil), pt...)
+	ct = aead.Seal(buf[:0], nonce, buf, nil)
+	if got, err := aead.Open(ct[:0], nonce, ct, nil); err != nil || !bytes.Equal(got, pt) {
+		t.Errorf("in place Open = %x, %v", got, err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ct, data []byte
+	}{
+		{"modified ciphertext", flipBit(want, 0), data},
+		{"modified tag", flipBit(want, len(want)-1), data},
+		{"modified data", want, flipBit(data, 0)},
+		{"missing data", want, nil},
+		{"truncated", want[:15], data},
+	} {
+		if _, err := aead.Open(nil, nonce, tc.ct, tc.data); err == nil {
+			t.Errorf("opened with %s", tc.name)
+		}
+	}
+
+	for _, size := range [][2]int{{6, 16}, {14, 16}, {12, 3}, {12, 18}, {12, 7}} {
+		if _, err := NewCCM(make([]byte, 16), size[0], size[1]); err == nil {
+			t.Errorf("accepted nonce size %d and tag size %d", size[0], size[1])
+		}
+	}
+}
+
+func flipBit(b []byte, i int) []byte {
+	b = append([]byte(nil), b...)
+	b[i] ^= 1
+	return b
+}
@@ -0,0 +1,583 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm9
+
+// The BN curve and R-ate pairing of GM/T 0044-2016 part 1. Field elements
+// are math/big integers in affine coordinates; this is written for
+// clarity, not speed, and is not constant time.
+
+import (
+	"errors"
+	"math/big"
+)
+
+func bigFromHex(s string) *big.Int {
+	b, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("sm9: internal error: invalid encoding")
+	}
+	return b
+}
+
+var (
+	// p is the characteristic of the base field, 36t^4 + 36t^3 + 24t^2 +
+	// 6t + 1 for t = 0x600000000058F98A.
+	p = bigFromHex("B640000002A3A6F1D603AB4FF58EC74521F2934B1A7AEEDBE56F9B27E351457D")
+	// Order is the prime order N of G1, G2 and GT, 36t^4 + 36t^3 +
+	// 18t^2 + 6t + 1.
+	Order = bigFromHex("B640000002A3A6F1D603AB4FF58EC74449F2934B18EA8BEEE56EE19CD69ECF25")
+	// sixTPlus2 is the Miller loop parameter a = 6t + 2.
+	sixTPlus2 = bigFromHex("2400000000215D93E")
+
+	curveB  = big.NewInt(5)
+	twistB  = fp2{new(big.Int), big.NewInt(5)} // 5u
+	negHalf = new(big.Int).Rsh(p, 1)            // -1/2 mod p = (p - 1) / 2
+
+	one = big.NewInt(1)
+
+	// g1Gen is P1, the generator of G1.
+	g1Gen = &G1{
+		x: bigFromHex("93DE051D62BF718FF5ED0704487D01D6E1E4086909DC3280E8C4E4817C66DDDD"),
+		y: bigFromHex("21FE8DDA4F21E607631065125C395BBC1C1C00CBFA6024350C464CD70A3EA616"),
+	}
+	// g2Gen is P2, the generator of G2.
+	g2Gen = &G2{
+		x: fp2{
+			bigFromHex("3722755292130B08D2AAB97FD34EC120EE265948D19C17ABF9B7213BAF82D65B"),
+			bigFromHex("85AEF3D078640C98597B6027B441A01FF1DD2C190F5E93C454806C11D8806141"),
+		},
+		y: fp2{
+			bigFromHex("A7CF28D519BE3DA65F3170153D278FF247EFBA98A71A08116215BBA5C999A7C7"),
+			bigFromHex("17509B092E845C1266BA0D262CBEE6ED0736A96FA347C8BD856DC76B84EBEB96"),
+		},
+	}
+
+	// frobGamma[i] is w^(i*(p-1)), so that the Frobenius map sends the
+	// coefficient of w^i to itself times frobGamma[i].
+	frobGamma = func() [12]*big.Int {
+		var g [12]*big.Int
+		e := new(big.Int).Sub(p, one)
+		e.Div(e, big.NewInt(12))
+		gamma := new(big.Int).Exp(new(big.Int).Sub(p, big.NewInt(2)), e, p)
+		g[0] = big.NewInt(1)
+		for i := 1; i < 12; i++ {
+			g[i] = fpMul(g[i-1], gamma)
+		}
+		return g
+	}()
+	// hardExp is (p^4 - p^2 + 1) / N, the hard part of the final
+	// exponentiation.
+	hardExp = func() *big.Int {
+		p2 := new(big.Int).Mul(p, p)
+		e := new(big.Int).Mul(p2, p2)
+		e.Sub(e, p2)
+		e.Add(e, one)
+		return e.Div(e, Order)
+	}()
+)
+
+// putBytes writes x to buf as a big endian number padded with zeros.
+func putBytes(buf []byte, x *big.Int) {
+	b := x.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+}
+
+func fpMul(a, b *big.Int) *big.Int {
+	c := new(big.Int).Mul(a, b)
+	return c.Mod(c, p)
+}
+
+func fpAdd(a, b *big.Int) *big.Int {
+	c := new(big.Int).Add(a, b)
+	return c.Mod(c, p)
+}
+
+func fpSub(a, b *big.Int) *big.Int {
+	c := new(big.Int).Sub(a, b)
+	return c.Mod(c, p)
+}
+
+// fp2 is the element a0 + a1*u of Fp2 = Fp[u]/(u^2 + 2).
+type fp2 struct {
+	a0, a1 *big.Int
+}
+
+func (a fp2) isZero() bool {
+	return a.a0.Sign() == 0 && a.a1.Sign() == 0
+}
+
+func fp2Equal(a, b fp2) bool {
+	return a.a0.Cmp(b.a0) == 0 && a.a1.Cmp(b.a1) == 0
+}
+
+func fp2Add(a, b fp2) fp2 {
+	return fp2{fpAdd(a.a0, b.a0), fpAdd(a.a1, b.a1)}
+}
+
+func fp2Sub(a, b fp2) fp2 {
+	return fp2{fpSub(a.a0, b.a0), fpSub(a.a1, b.a1)}
+}
+
+func fp2Neg(a fp2) fp2 {
+	return fp2Sub(fp2{new(big.Int), new(big.Int)}, a)
+}
+
+func fp2Mul(a, b fp2) fp2 {
+	// (a0 + a1 u)(b0 + b1 u) = a0 b0 - 2 a1 b1 + (a0 b1 + a1 b0) u
+	c0 := new(big.Int).Mul(a.a1, b.a1)
+	c0.Lsh(c0, 1)
+	c0.Sub(new(big.Int).Mul(a.a0, b.a0), c0)
+	c1 := new(big.Int).Mul(a.a0, b.a1)
+	c1.Add(c1, new(big.Int).Mul(a.a1, b.a0))
+	return fp2{c0.Mod(c0, p), c1.Mod(c1, p)}
+}
+
+func fp2MulFp(a fp2, k *big.Int) fp2 {
+	return fp2{fpMul(a.a0, k), fpMul(a.a1, k)}
+}
+
+func fp2Inv(a fp2) fp2 {
+	// (a0 + a1 u)^-1 = (a0 - a1 u) / (a0^2 + 2 a1^2)
+	d := new(big.Int).Mul(a.a1, a.a1)
+	d.Lsh(d, 1)
+	d.Add(d, new(big.Int).Mul(a.a0, a.a0))
+	d.ModInverse(d.Mod(d, p), p)
+	return fp2{fpMul(a.a0, d), fpSub(new(big.Int), fpMul(a.a1, d))}
+}
+
+// G1 is an element of the group G1, a point on E: y^2 = x^3 + 5 over Fp.
+// The zero value is the point at infinity.
+type G1 struct {
+	x, y *big.Int
+}
+
+// IsInfinity reports whether e is the point at infinity.
+func (e *G1) IsInfinity() bool {
+	return e.x == nil
+}
+
+// Equal reports whether e and a are the same point.
+func (e *G1) Equal(a *G1) bool {
+	if e.IsInfinity() || a.IsInfinity() {
+		return e.IsInfinity() == a.IsInfinity()
+	}
+	return e.x.Cmp(a.x) == 0 && e.y.Cmp(a.y) == 0
+}
+
+// Marshal returns the 64 byte encoding x || y of e, all zero for the point
+// at infinity.
+func (e *G1) Marshal() []byte {
+	out := make([]byte, 64)
+	if !e.IsInfinity() {
+		putBytes(out[:32], e.x)
+		putBytes(out[32:], e.y)
+	}
+	return out
+}
+
+// Unmarshal sets e to the point encoded by data, the output of Marshal. It
+// rejects encodings of points not on the curve, including infinity.
+func (e *G1) Unmarshal(data []byte) error {
+	if len(data) != 64 {
+		return errors.New("SM9: invalid G1 point encoding length")
+	}
+	x := new(big.Int).SetBytes(data[:32])
+	y := new(big.Int).SetBytes(data[32:])
+	if x.Cmp(p) >= 0 || y.Cmp(p) >= 0 {
+		return errors.New("SM9: G1 point coordinate out of range")
+	}
+	// E(Fp) has prime order N, so every point on it is in G1.
+	if !g1OnCurve(x, y) {
+		return errors.New("SM9: G1 point is not on the curve")
+	}
+	e.x, e.y = x, y
+	return nil
+}
+
+func g1OnCurve(x, y *big.Int) bool {
+	x3 := new(big.Int).Mul(x, x)
+	x3.Mul(x3, x)
+	x3.Add(x3, curveB)
+	return fpMul(y, y).Cmp(x3.Mod(x3, p)) == 0
+}
+
+func g1Neg(a *G1) *G1 {
+	if a.IsInfinity() {
+		return a
+	}
+	return &G1{a.x, fpSub(new(big.Int), a.y)}
+}
+
+// Points are never modified once created, so g1Add and g1Double may
+// return their arguments.
+func g1Add(a, b *G1) *G1 {
+	if a.IsInfinity() {
+		return b
+	}
+	if b.IsInfinity() {
+		return a
+	}
+	if a.x.Cmp(b.x) == 0 {
+		if a.y.Cmp(b.y) == 0 {
+			return g1Double(a)
+		}
+		return &G1{}
+	}
+	lambda := fpMul(fpSub(b.y, a.y), new(big.Int).ModInverse(fpSub(b.x, a.x), p))
+	return g1Line(a, b, lambda)
+}
+
+func g1Double(a *G1) *G1 {
+	if a.IsInfinity() || a.y.Sign() == 0 {
+		return &G1{}
+	}
+	num := new(big.Int).Mul(a.x, a.x)
+	num.Mul(num, big.NewInt(3))
+	lambda := fpMul(num, new(big.Int).ModInverse(fpAdd(a.y, a.y), p))
+	return g1Line(a, a, lambda)
+}
+
+// g1Line returns the third intersection, negated, of the line of slope
+// lambda through a and b.
+func g1Line(a, b *G1, lambda *big.Int) *G1 {
+	x := fpMul(lambda, lambda)
+	x = fpSub(fpSub(x, a.x), b.x)
+	y := fpSub(fpMul(lambda, fpSub(a.x, x)), a.y)
+	return &G1{x, y}
+}
+
+func g1ScalarMult(a *G1, k *big.Int) *G1 {
+	r := &G1{}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = g1Double(r)
+		if k.Bit(i) == 1 {
+			r = g1Add(r, a)
+		}
+	}
+	return r
+}
+
+// G2 is an element of the group G2, a point on the twist E': y^2 = x^3 +
+// 5u over Fp2. The zero value is the point at infinity.
+type G2 struct {
+	x, y fp2
+}
+
+// IsInfinity reports whether e is the point at infinity.
+func (e *G2) IsInfinity() bool {
+	return e.x.a0 == nil
+}
+
+// Equal reports whether e and a are the same point.
+func (e *G2) Equal(a *G2) bool {
+	if e.IsInfinity() || a.IsInfinity() {
+		return e.IsInfinity() == a.IsInfinity()
+	}
+	return fp2Equal(e.x, a.x) && fp2Equal(e.y, a.y)
+}
+
+// Marshal returns the 128 byte encoding x1 || x0 || y1 || y0 of e, where x
+// = x0 + x1*u and y = y0 + y1*u, all zero for the point at infinity.
+func (e *G2) Marshal() []byte {
+	out := make([]byte, 128)
+	if !e.IsInfinity() {
+		putBytes(out[:32], e.x.a1)
+		putBytes(out[32:64], e.x.a0)
+		putBytes(out[64:96], e.y.a1)
+		putBytes(out[96:], e.y.a0)
+	}
+	return out
+}
+
+// Unmarshal sets e to the point encoded by data, the output of Marshal. It
+// rejects encodings of points outside G2, including infinity.
+func (e *G2) Unmarshal(data []byte) error {
+	if len(data) != 128 {
+		return errors.New("SM9: invalid G2 point encoding length")
+	}
+	var c [4]*big.Int
+	for i := range c {
+		c[i] = new(big.Int).SetBytes(data[32*i : 32*(i+1)])
+		if c[i].Cmp(p) >= 0 {
+			return errors.New("SM9: G2 point coordinate out of range")
+		}
+	}
+	a := &G2{x: fp2{c[1], c[0]}, y: fp2{c[3], c[2]}}
+	if !g2OnCurve(a) {
+		return errors.New("SM9: G2 point is not on the curve")
+	}
+	// Unlike E(Fp), the twist has a cofactor.
+	if !g2ScalarMult(a, Order).IsInfinity() {
+		return errors.New("SM9: G2 point is not in the subgroup")
+	}
+	*e = *a
+	return nil
+}
+
+func g2OnCurve(a *G2) bool {
+	x3 := fp2Mul(fp2Mul(a.x, a.x), a.x)
+	return fp2Equal(fp2Mul(a.y, a.y), fp2Add(x3, twistB))
+}
+
+func g2Neg(a *G2) *G2 {
+	if a.IsInfinity() {
+		return a
+	}
+	return &G2{x: a.x, y: fp2Neg(a.y)}
+}
+
+// g2Slope returns the slope of the line through a and b, the tangent if
+// they are equal, and false if that line is vertical.
+func g2Slope(a, b *G2) (fp2, bool) {
+	if fp2Equal(a.x, b.x) {
+		if !fp2Equal(a.y, b.y) || a.y.isZero() {
+			return fp2{}, false
+		}
+		num := fp2Mul(a.x, a.x)
+		num = fp2Add(fp2Add(num, num), num)
+		return fp2Mul(num, fp2Inv(fp2Add(a.y, a.y))), true
+	}
+	return fp2Mul(fp2Sub(b.y, a.y), fp2Inv(fp2Sub(b.x, a.x))), true
+}
+
+func g2Line(a, b *G2, lambda fp2) *G2 {
+	x := fp2Sub(fp2Sub(fp2Mul(lambda, lambda), a.x), b.x)
+	y := fp2Sub(fp2Mul(lambda, fp2Sub(a.x, x)), a.y)
+	return &G2{x: x, y: y}
+}
+
+func g2Add(a, b *G2) *G2 {
+	if a.IsInfinity() {
+		return b
+	}
+	if b.IsInfinity() {
+		return a
+	}
+	lambda, ok := g2Slope(a, b)
+	if !ok {
+		return &G2{}
+	}
+	return g2Line(a, b, lambda)
+}
+
+func g2ScalarMult(a *G2, k *big.Int) *G2 {
+	r := &G2{}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = g2Add(r, r)
+		if k.Bit(i) == 1 {
+			r = g2Add(r, a)
+		}
+	}
+	return r
+}
+
+// fp12 is the element sum a[i]*w^i of Fp12 = Fp[w]/(w^12 + 2). This is
+// the tower Fp4 = Fp2[v]/(v^2 - u), Fp12 = Fp4[w]/(w^3 - v) of GM/T 0044
+// in the basis v = w^3, u = w^6. The twist E' maps into E(Fp12) by (x, y)
+// -> (x w^-2, y w^-3).
+type fp12 [12]*big.Int
+
+func newFp12() *fp12 {
+	a := new(fp12)
+	for i := range a {
+		a[i] = new(big.Int)
+	}
+	return a
+}
+
+func fp12One() *fp12 {
+	a := newFp12()
+	a[0].SetInt64(1)
+	return a
+}
+
+func fp12Equal(a, b *fp12) bool {
+	for i := range a {
+		if a[i].Cmp(b[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addTerm adds c*w^k to a for -12 <= k < 24.
+func (a *fp12) addTerm(c *big.Int, k int) {
+	t := new(big.Int).Set(c)
+	switch {
+	case k < 0:
+		k += 12
+		t.Mul(t, negHalf) // w^-12 = -1/2
+	case k >= 12:
+		k -= 12
+		t.Neg(t.Lsh(t, 1)) // w^12 = -2
+	}
+	a[k].Add(a[k], t).Mod(a[k], p)
+}
+
+// addFp2Term adds c*w^k to a, for c in Fp2 and -12 <= k < 18.
+func (a *fp12) addFp2Term(c fp2, k int) {
+	a.addTerm(c.a0, k)
+	a.addTerm(c.a1, k+6)
+}
+
+func fp12Mul(a, b *fp12) *fp12 {
+	var acc [23]big.Int
+	t := new(big.Int)
+	for i := range a {
+		if a[i].Sign() == 0 {
+			continue
+		}
+		for j := range b {
+			if b[j].Sign() == 0 {
+				continue
+			}
+			acc[i+j].Add(&acc[i+j], t.Mul(a[i], b[j]))
+		}
+	}
+	c := new(fp12)
+	for k := range c {
+		c[k] = new(big.Int).Set(&acc[k])
+		if k+12 < len(acc) {
+			c[k].Sub(c[k], t.Lsh(&acc[k+12], 1))
+		}
+		c[k].Mod(c[k], p)
+	}
+	return c
+}
+
+// fp12Frobenius returns a^p.
+func fp12Frobenius(a *fp12) *fp12 {
+	c := new(fp12)
+	for i := range a {
+		c[i] = fpMul(a[i], frobGamma[i])
+	}
+	return c
+}
+
+// fp12Inv returns a^-1 as the product of the other conjugates of a divided
+// by its norm.
+func fp12Inv(a *fp12) *fp12 {
+	conj := fp12One()
+	b := a
+	for i := 1; i < 12; i++ {
+		b = fp12Frobenius(b)
+		conj = fp12Mul(conj, b)
+	}
+	norm := fp12Mul(a, conj)[0] // in Fp
+	norm.ModInverse(norm, p)
+	for i := range conj {
+		conj[i] = fpMul(conj[i], norm)
+	}
+	return conj
+}
+
+func fp12Exp(a *fp12, k *big.Int) *fp12 {
+	r := fp12One()
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = fp12Mul(r, r)
+		if k.Bit(i) == 1 {
+			r = fp12Mul(r, a)
+		}
+	}
+	return r
+}
+
+// gtOrder lists the powers of w in the order GM/T 0044 writes the
+// coefficients of an Fp12 element: highest first at every level of the
+// tower.
+var gtOrder = [12]int{11, 5, 8, 2, 10, 4, 7, 1, 9, 3, 6, 0}
+
+// fp12Bytes returns the 384 byte encoding of a used by the hash functions.
+func fp12Bytes(a *fp12) []byte {
+	out := make([]byte, 384)
+	for i, k := range gtOrder {
+		putBytes(out[32*i : 32*(i+1)], a[k])
+	}
+	return out
+}
+
+// g2Frobenius returns the image of a under the p-power Frobenius map of
+// E(Fp12), pulled back to the twist.
+func g2Frobenius(a *G2) *G2 {
+	x, y := newFp12(), newFp12()
+	x.addFp2Term(a.x, -2)
+	y.addFp2Term(a.y, -3)
+	x, y = fp12Frobenius(x), fp12Frobenius(y)
+	// multiply by w^2 and w^3 again; the results lie in Fp2
+	x2, y2 := newFp12(), newFp12()
+	for i := range x {
+		x2.addTerm(x[i], i+2)
+		y2.addTerm(y[i], i+3)
+	}
+	return &G2{x: fp2{x2[0], x2[6]}, y: fp2{y2[0], y2[6]}}
+}
+
+// lineEval returns T + R and the line through T and R (the tangent when
+// they are equal), mapped into E(Fp12), evaluated at P.
+func lineEval(t, r *G2, pt *G1) (*G2, *fp12) {
+	l := newFp12()
+	lambda, ok := g2Slope(t, r)
+	if !ok {
+		// xP - xT w^-2
+		l.addTerm(pt.x, 0)
+		l.addFp2Term(fp2Neg(t.x), -2)
+		return &G2{}, l
+	}
+	// The slope on E is lambda w^-1, so the line is
+	// yP - yT w^-3 - lambda w^-1 (xP - xT w^-2).
+	l.addTerm(pt.y, 0)
+	l.addFp2Term(fp2Sub(fp2Mul(lambda, t.x), t.y), -3)
+	l.addFp2Term(fp2Neg(fp2MulFp(lambda, pt.x)), -1)
+	return g2Line(t, r, lambda), l
+}
+
+// pair computes the R-ate pairing e(P, Q).
+func pair(pt *G1, q *G2) *fp12 {
+	if pt.IsInfinity() || q.IsInfinity() {
+		return fp12One()
+	}
+	f := fp12One()
+	t := q
+	var l *fp12
+	for i := sixTPlus2.BitLen() - 2; i >= 0; i-- {
+		t, l = lineEval(t, t, pt)
+		f = fp12Mul(fp12Mul(f, f), l)
+		if sixTPlus2.Bit(i) == 1 {
+			t, l = lineEval(t, q, pt)
+			f = fp12Mul(f, l)
+		}
+	}
+	q1 := g2Frobenius(q)
+	q2 := g2Neg(g2Frobenius(q1))
+	t, l = lineEval(t, q1, pt)
+	f = fp12Mul(f, l)
+	_, l = lineEval(t, q2, pt)
+	f = fp12Mul(f, l)
+	return finalExponentiation(f)
+}
+
+// finalExponentiation returns f^((p^12 - 1) / N).
+func finalExponentiation(f *fp12) *fp12 {
+	// f^(p^6 - 1)
+	t := f
+	for i := 0; i < 6; i++ {
+		t = fp12Frobenius(t)
+	}
+	f = fp12Mul(t, fp12Inv(f))
+	// f^(p^2 + 1)
+	f = fp12Mul(fp12Frobenius(fp12Frobenius(f)), f)
+	return fp12Exp(f, hardExp)
+}
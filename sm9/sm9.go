@@ -0,0 +1,327 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sm9 implements the SM9 identity based signature and encryption
+// schemes of GM/T 0044-2016. A key generation center (KGC) holds a master
+// key and extracts the private key of a user from the user's identity;
+// anyone can verify signatures or encrypt to an identity with the master
+// public key alone.
+//
+// The arithmetic uses math/big and is not constant time.
+package sm9
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/tjfoc/gmsm/sm3"
+)
+
+const (
+	// SignHID is the function identifier hid that GM/T 0044 assigns to
+	// signature keys.
+	SignHID byte = 0x01
+	// EncryptHID is the function identifier hid for encryption keys.
+	EncryptHID byte = 0x03
+)
+
+// SignMasterPublicKey is the public key Ppub-s = [ks]P2 of a signature
+// master key.
+type SignMasterPublicKey struct {
+	P *G2
+}
+
+// SignMasterKey is the signature master key ks of a KGC.
+type SignMasterKey struct {
+	SignMasterPublicKey
+	D *big.Int
+}
+
+// SignPrivateKey is the signature key dsA = [ks / (H1(ID || hid) + ks)]P1
+// of a user.
+type SignPrivateKey struct {
+	SignMasterPublicKey
+	K *G1
+}
+
+// EncryptMasterPublicKey is the public key Ppub-e = [ke]P1 of an
+// encryption master key.
+type EncryptMasterPublicKey struct {
+	P *G1
+}
+
+// EncryptMasterKey is the encryption master key ke of a KGC.
+type EncryptMasterKey struct {
+	EncryptMasterPublicKey
+	D *big.Int
+}
+
+// EncryptPrivateKey is the decryption key deB = [ke / (H1(ID || hid) +
+// ke)]P2 of a user.
+type EncryptPrivateKey struct {
+	EncryptMasterPublicKey
+	K *G2
+}
+
+// randScalar returns a uniform k in [1, N-1].
+func randScalar(random io.Reader) (*big.Int, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	b := make([]byte, 40)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return nil, err
+	}
+	k := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(Order, one)
+	k.Mod(k, n)
+	return k.Add(k, one), nil
+}
+
+// hashToRange is the function H1 (prefix 1) or H2 (prefix 2) of GM/T 0044:
+// 40 bytes of SM3(prefix || z || ct) for ct = 1, 2, reduced to [1, N-1].
+func hashToRange(prefix byte, z ...[]byte) *big.Int {
+	var ct [4]byte
+	var ha []byte
+	h := sm3.New()
+	for i := uint32(1); len(ha) < 40; i++ {
+		binary.BigEndian.PutUint32(ct[:], i)
+		h.Reset()
+		h.Write([]byte{prefix})
+		for _, b := range z {
+			h.Write(b)
+		}
+		h.Write(ct[:])
+		ha = append(ha, h.Sum(nil)...)
+	}
+	k := new(big.Int).SetBytes(ha[:40])
+	n := new(big.Int).Sub(Order, one)
+	k.Mod(k, n)
+	return k.Add(k, one)
+}
+
+// userScalar returns ks / (H1(ID || hid) + ks) mod N, the scalar of a user
+// private key.
+func userScalar(master *big.Int, id []byte, hid byte) (*big.Int, error) {
+	t1 := hashToRange(1, id, []byte{hid})
+	t1.Add(t1, master)
+	t1.Mod(t1, Order)
+	if t1.Sign() == 0 {
+		// The standard asks the KGC to pick a new master key.
+		return nil, errors.New("SM9: identity is unusable with this master key")
+	}
+	t1.ModInverse(t1, Order)
+	t1.Mul(t1, master)
+	return t1.Mod(t1, Order), nil
+}
+
+// GenerateSignMasterKey generates a signature master key, reading
+// randomness from random. crypto/rand.Reader is used when random is nil.
+func GenerateSignMasterKey(random io.Reader) (*SignMasterKey, error) {
+	k, err := randScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	return newSignMasterKey(k), nil
+}
+
+func newSignMasterKey(k *big.Int) *SignMasterKey {
+	master := &SignMasterKey{D: k}
+	master.P = g2ScalarMult(g2Gen, k)
+	return master
+}
+
+// GenerateUserKey extracts the signature key of the user id. hid is
+// normally SignHID.
+func (master *SignMasterKey) GenerateUserKey(id []byte, hid byte) (*SignPrivateKey, error) {
+	t2, err := userScalar(master.D, id, hid)
+	if err != nil {
+		return nil, err
+	}
+	priv := &SignPrivateKey{SignMasterPublicKey: master.SignMasterPublicKey}
+	priv.K = g1ScalarMult(g1Gen, t2)
+	return priv, nil
+}
+
+// Sign signs msg with priv, reading randomness from random, and returns
+// the signature (h, S). crypto/rand.Reader is used when random is nil.
+func Sign(random io.Reader, priv *SignPrivateKey, msg []byte) (h *big.Int, s *G1, err error) {
+	g := pair(g1Gen, priv.P)
+	for {
+		r, err := randScalar(random)
+		if err != nil {
+			return nil, nil, err
+		}
+		if h, s = sign(priv, g, msg, r); h != nil {
+			return h, s, nil
+		}
+	}
+}
+
+// sign computes the signature of msg for the nonce r and g = e(P1,
+// Ppub-s), or returns nil if r must be replaced.
+func sign(priv *SignPrivateKey, g *fp12, msg []byte, r *big.Int) (*big.Int, *G1) {
+	w := fp12Exp(g, r)
+	h := hashToRange(2, msg, fp12Bytes(w))
+	l := new(big.Int).Sub(r, h)
+	l.Mod(l, Order)
+	if l.Sign() == 0 {
+		return nil, nil
+	}
+	return h, g1ScalarMult(priv.K, l)
+}
+
+// Verify reports whether (h, S) is a valid signature of msg by the user id
+// of the KGC with master public key pub.
+func Verify(pub *SignMasterPublicKey, id []byte, hid byte, msg []byte, h *big.Int, s *G1) bool {
+	if h == nil || h.Sign() <= 0 || h.Cmp(Order) >= 0 {
+		return false
+	}
+	if s == nil || s.IsInfinity() || !g1OnCurve(s.x, s.y) {
+		return false
+	}
+	t := fp12Exp(pair(g1Gen, pub.P), h)
+	h1 := hashToRange(1, id, []byte{hid})
+	q := g2Add(g2ScalarMult(g2Gen, h1), pub.P)
+	w := fp12Mul(pair(s, q), t)
+	return hashToRange(2, msg, fp12Bytes(w)).Cmp(h) == 0
+}
+
+// GenerateEncryptMasterKey generates an encryption master key, reading
+// randomness from random. crypto/rand.Reader is used when random is nil.
+func GenerateEncryptMasterKey(random io.Reader) (*EncryptMasterKey, error) {
+	k, err := randScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptMasterKey(k), nil
+}
+
+func newEncryptMasterKey(k *big.Int) *EncryptMasterKey {
+	master := &EncryptMasterKey{D: k}
+	master.P = g1ScalarMult(g1Gen, k)
+	return master
+}
+
+// GenerateUserKey extracts the decryption key of the user id. hid is
+// normally EncryptHID.
+func (master *EncryptMasterKey) GenerateUserKey(id []byte, hid byte) (*EncryptPrivateKey, error) {
+	t2, err := userScalar(master.D, id, hid)
+	if err != nil {
+		return nil, err
+	}
+	priv := &EncryptPrivateKey{EncryptMasterPublicKey: master.EncryptMasterPublicKey}
+	priv.K = g2ScalarMult(g2Gen, t2)
+	return priv, nil
+}
+
+// Encrypt encrypts msg to the user id of the KGC with master public key
+// pub, reading randomness from random, and returns C1 || C3 || C2. The
+// message is masked with the KDF output, the stream cipher mode of GM/T
+// 0044, and C3 is the MAC SM3(C2 || K2). crypto/rand.Reader is used when
+// random is nil.
+func Encrypt(random io.Reader, pub *EncryptMasterPublicKey, id []byte, hid byte, msg []byte) ([]byte, error) {
+	h1 := hashToRange(1, id, []byte{hid})
+	q := g1Add(g1ScalarMult(g1Gen, h1), pub.P)
+	g := pair(pub.P, g2Gen)
+	for {
+		r, err := randScalar(random)
+		if err != nil {
+			return nil, err
+		}
+		if c := encrypt(q, g, id, msg, r); c != nil {
+			return c, nil
+		}
+	}
+}
+
+// encrypt encrypts msg for QB = [H1(ID || hid)]P1 + Ppub-e, g = e(Ppub-e,
+// P2) and the nonce r, or returns nil if r must be replaced.
+func encrypt(q *G1, g *fp12, id, msg []byte, r *big.Int) []byte {
+	c1 := g1ScalarMult(q, r).Marshal()
+	w := fp12Exp(g, r)
+	k := kdf(c1, w, id, len(msg))
+	if k == nil {
+		return nil
+	}
+	c2 := make([]byte, len(msg))
+	for i, b := range msg {
+		c2[i] = b ^ k[i]
+	}
+	c := make([]byte, 0, len(c1)+32+len(c2))
+	c = append(c, c1...)
+	c = append(c, macSum(k[len(msg):], c2)...)
+	return append(c, c2...)
+}
+
+// kdf returns K1 || K2, the mask for an n byte message followed by the 32
+// byte MAC key, or nil if K1 is all zero.
+func kdf(c1 []byte, w *fp12, id []byte, n int) []byte {
+	z := make([]byte, 0, len(c1)+384+len(id))
+	z = append(z, c1...)
+	z = append(z, fp12Bytes(w)...)
+	z = append(z, id...)
+	k := sm3.KDF(z, n+32)
+	if k == nil {
+		return nil
+	}
+	if n == 0 {
+		return k
+	}
+	for _, b := range k[:n] {
+		if b != 0 {
+			return k
+		}
+	}
+	return nil
+}
+
+// macSum returns MAC(K2, Z) = SM3(Z || K2).
+func macSum(k2, z []byte) []byte {
+	h := sm3.New()
+	h.Write(z)
+	h.Write(k2)
+	return h.Sum(nil)
+}
+
+// Decrypt decrypts the ciphertext C1 || C3 || C2 of Encrypt with the
+// decryption key of the user id.
+func Decrypt(priv *EncryptPrivateKey, id []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 96 {
+		return nil, errors.New("Decrypt: ciphertext too short")
+	}
+	c1 := new(G1)
+	if err := c1.Unmarshal(ciphertext[:64]); err != nil {
+		return nil, err
+	}
+	c3, c2 := ciphertext[64:96], ciphertext[96:]
+	w := pair(c1, priv.K)
+	k := kdf(ciphertext[:64], w, id, len(c2))
+	if k == nil {
+		return nil, errors.New("Decrypt: failed to decrypt")
+	}
+	if subtle.ConstantTimeCompare(macSum(k[len(c2):], c2), c3) != 1 {
+		return nil, errors.New("Decrypt: failed to decrypt")
+	}
+	msg := make([]byte, len(c2))
+	for i, b := range c2 {
+		msg[i] = b ^ k[i]
+	}
+	return msg, nil
+}
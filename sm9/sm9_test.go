@@ -0,0 +1,233 @@
+/*
+Copyright Suzhou Tongji Fintech Research Institute 2017 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sm9
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestCurveParams(t *testing.T) {
+	x := big.NewInt(0x600000000058F98A)
+	poly := func(c ...int64) *big.Int { // c[0] + c[1] x + ...
+		r := new(big.Int)
+		for i := len(c) - 1; i >= 0; i-- {
+			r.Mul(r, x)
+			r.Add(r, big.NewInt(c[i]))
+		}
+		return r
+	}
+	if poly(1, 6, 24, 36, 36).Cmp(p) != 0 {
+		t.Error("p does not match t")
+	}
+	if poly(1, 6, 18, 36, 36).Cmp(Order) != 0 {
+		t.Error("N does not match t")
+	}
+	if poly(2, 6).Cmp(sixTPlus2) != 0 {
+		t.Error("a does not match t")
+	}
+	if !g1OnCurve(g1Gen.x, g1Gen.y) || !g1ScalarMult(g1Gen, Order).IsInfinity() {
+		t.Error("P1 is not a point of order N")
+	}
+	if !g2OnCurve(g2Gen) || !g2ScalarMult(g2Gen, Order).IsInfinity() {
+		t.Error("P2 is not a point of order N")
+	}
+	if q := g2Frobenius(g2Gen); !g2OnCurve(q) || q.Equal(g2Gen) {
+		t.Error("Frobenius of P2 is wrong")
+	}
+}
+
+func TestPairing(t *testing.T) {
+	e := pair(g1Gen, g2Gen)
+	if fp12Equal(e, fp12One()) {
+		t.Fatal("pairing is degenerate")
+	}
+	if !fp12Equal(fp12Exp(e, Order), fp12One()) {
+		t.Error("e(P1, P2) is not of order N")
+	}
+	a, b := big.NewInt(0x1234567), big.NewInt(0x89abcdef)
+	ab := new(big.Int).Mul(a, b)
+	if !fp12Equal(pair(g1ScalarMult(g1Gen, a), g2ScalarMult(g2Gen, b)), fp12Exp(e, ab)) {
+		t.Error("pairing is not bilinear")
+	}
+	if !fp12Equal(fp12Mul(e, fp12Inv(e)), fp12One()) {
+		t.Error("wrong Fp12 inverse")
+	}
+}
+
+func TestPointMarshal(t *testing.T) {
+	var a G1
+	if err := a.Unmarshal(g1Gen.Marshal()); err != nil || !a.Equal(g1Gen) {
+		t.Errorf("G1 round trip: %v", err)
+	}
+	var b G2
+	if err := b.Unmarshal(g2Gen.Marshal()); err != nil || !b.Equal(g2Gen) {
+		t.Errorf("G2 round trip: %v", err)
+	}
+	if err := a.Unmarshal(make([]byte, 64)); err == nil {
+		t.Error("G1 accepted the point at infinity")
+	}
+	if err := b.Unmarshal(make([]byte, 128)); err == nil {
+		t.Error("G2 accepted the point at infinity")
+	}
+	bad := g1Gen.Marshal()
+	bad[63] ^= 1
+	if err := a.Unmarshal(bad); err == nil {
+		t.Error("G1 accepted a point off the curve")
+	}
+}
+
+func fromHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The signature example of GM/T 0044-2016 part 5, appendix A.
+func TestSignVector(t *testing.T) {
+	master := newSignMasterKey(bigFromHex("0130E78459D78545CB54C587E02CF480CE0B66340F319F348A1D5B1F2DC5F4"))
+	wantPub := fromHex("9F64080B3084F733E48AFF4B41B565011CE0711C5E392CFB0AB1B6791B94C408" +
+		"29DBA116152D1F786CE843ED24A3B573414D2177386A92DD8F14D65696EA5E32" +
+		"69850938ABEA0112B57329F447E3A0CBAD3E2FDB1A77F335E89E1408D0EF1C25" +
+		"41E00A53DDA532DA1A7CE027B7A46F741006E85F5CDFF0730E75C05FB4E3216D")
+	if !bytes.Equal(master.P.Marshal(), wantPub) {
+		t.Errorf("Ppub-s = %X", master.P.Marshal())
+	}
+	id, msg := []byte("Alice"), []byte("Chinese IBS standard")
+	priv, err := master.GenerateUserKey(id, SignHID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKey := fromHex("A5702F05CF1315305E2D6EB64B0DEB923DB1A0BCF0CAFF90523AC8754AA69820" +
+		"78559A844411F9825C109F5EE3F52D720DD01785392A727BB1556952B2B013D3")
+	if !bytes.Equal(priv.K.Marshal(), wantKey) {
+		t.Errorf("dsA = %X", priv.K.Marshal())
+	}
+	r := bigFromHex("033C8616B06704813203DFD00965022ED15975C662337AED648835DC4B1CBE")
+	h, s := sign(priv, pair(g1Gen, master.P), msg, r)
+	if want := bigFromHex("823C4B21E4BD2DFE1ED92C606653E996668563152FC33F55D7BFBB9BD9705ADB"); h.Cmp(want) != 0 {
+		t.Errorf("h = %X", h)
+	}
+	wantS := fromHex("73BF96923CE58B6AD0E13E9643A406D8EB98417C50EF1B29CEF9ADB48B6D598C" +
+		"856712F1C2E0968AB7769F42A99586AED139D5B8B3E15891827CC2ACED9BAA05")
+	if !bytes.Equal(s.Marshal(), wantS) {
+		t.Errorf("S = %X", s.Marshal())
+	}
+	if !Verify(&master.SignMasterPublicKey, id, SignHID, msg, h, s) {
+		t.Error("example signature does not verify")
+	}
+}
+
+// The encryption example of GM/T 0044-2016 part 4, appendix C.
+func TestEncryptVector(t *testing.T) {
+	master := newEncryptMasterKey(bigFromHex("01EDEE3778F441F8DEA3D9FA0ACC4E07EE36C93F9A08618AF4AD85CEDE1C22"))
+	wantPub := fromHex("787ED7B8A51F3AB84E0A66003F32DA5C720B17ECA7137D39ABC66E3C80A892FF" +
+		"769DE61791E5ADC4B9FF85A31354900B202871279A8C49DC3F220F644C57A7B1")
+	if !bytes.Equal(master.P.Marshal(), wantPub) {
+		t.Errorf("Ppub-e = %X", master.P.Marshal())
+	}
+	id, msg := []byte("Bob"), []byte("Chinese IBE standard")
+	priv, err := master.GenerateUserKey(id, EncryptHID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bigFromHex("AAC0541779C8FC45E3E2CB25C12B5D2576B2129AE8BB5EE2CBE5EC9E785C")
+	q := g1Add(g1ScalarMult(g1Gen, hashToRange(1, id, []byte{EncryptHID})), master.P)
+	c := encrypt(q, pair(master.P, g2Gen), id, msg, r)
+	want := fromHex("2445471164490618E1EE20528FF1D545B0F14C8BCAA44544F03DAB5DAC07D8FF" +
+		"42FFCA97D57CDDC05EA405F2E586FEB3A6930715532B8000759F13059ED59AC0" +
+		"BA672387BCD6DE5016A158A52BB2E7FC429197BCAB70B25AFEE37A2B9DB9F367" +
+		"1B5F5B0E951489682F3E64E1378CDD5DA9513B1C")
+	if !bytes.Equal(c, want) {
+		t.Errorf("C = %X", c)
+	}
+	pt, err := Decrypt(priv, id, want)
+	if err != nil || !bytes.Equal(pt, msg) {
+		t.Errorf("Decrypt = %q, %v", pt, err)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	master, err := GenerateSignMasterKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, msg := []byte("alice@example.com"), []byte("test")
+	priv, err := master.GenerateUserKey(id, SignHID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, s, err := Sign(nil, priv, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &master.SignMasterPublicKey
+	if !Verify(pub, id, SignHID, msg, h, s) {
+		t.Fatal("signature does not verify")
+	}
+	if Verify(pub, []byte("bob@example.com"), SignHID, msg, h, s) {
+		t.Error("signature verifies for another identity")
+	}
+	if Verify(pub, id, SignHID, []byte("tesT"), h, s) {
+		t.Error("signature verifies for another message")
+	}
+	if Verify(pub, id, SignHID, msg, new(big.Int).Add(h, one), s) {
+		t.Error("modified signature verifies")
+	}
+	if Verify(pub, id, SignHID, msg, h, &G1{}) {
+		t.Error("signature with S at infinity verifies")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	master, err := GenerateEncryptMasterKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte("bob@example.com")
+	priv, err := master.GenerateUserKey(id, EncryptHID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{{}, []byte("test"), bytes.Repeat([]byte{0x5a}, 100)} {
+		c, err := Encrypt(nil, &master.EncryptMasterPublicKey, id, EncryptHID, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) != 96+len(msg) {
+			t.Errorf("ciphertext length %d for %d byte message", len(c), len(msg))
+		}
+		pt, err := Decrypt(priv, id, c)
+		if err != nil || !bytes.Equal(pt, msg) {
+			t.Errorf("Decrypt = %x, %v, want %x", pt, err, msg)
+		}
+		if _, err := Decrypt(priv, []byte("alice@example.com"), c); err == nil {
+			t.Error("decrypted with another identity")
+		}
+		c[len(c)-1] ^= 1
+		if _, err := Decrypt(priv, id, c); err == nil {
+			t.Error("decrypted a modified ciphertext")
+		}
+	}
+	if _, err := Decrypt(priv, id, make([]byte, 95)); err == nil {
+		t.Error("decrypted a short ciphertext")
+	}
+}